@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+)
+
+func TestAPIKeyCannotManageKeys(t *testing.T) {
+	// models are left empty, any query would panic rather than pass
+	app := &application{}
+
+	owner := &data.User{ID: 1, Activated: true}
+	key := &data.APIKey{ID: 1, UserID: owner.ID, Permissions: data.Permissions{"images:write"}}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		params  httprouter.Params
+		handler http.HandlerFunc
+	}{
+		{"revoke a sibling key", http.MethodDelete, "/v1/api-keys/2", httprouter.Params{{Key: "id", Value: "2"}}, app.revokeAPIKeyHandler},
+		{"list keys", http.MethodGet, "/v1/api-keys", nil, app.listAPIKeysHandler},
+		{"create a key", http.MethodPost, "/v1/api-keys", nil, app.createAPIKeyHandler},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, tt.params))
+		r = app.contextSetUser(r, owner)
+		r = app.contextSetAPIKey(r, key)
+
+		w := httptest.NewRecorder()
+		app.requireAuthenticationToken(tt.handler).ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for a request made with an API key, got %d", tt.name, w.Code)
+		}
+	}
+}
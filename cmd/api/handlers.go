@@ -11,6 +11,8 @@ func (app *application) healthcheckHandler(writer http.ResponseWriter, request *
 			"environment": app.config.Env,
 			"version":     version,
 		},
+		"janitor":    app.janitor.Stats(),
+		"processing": app.pool.Stats(),
 	}
 
 	err := app.writeJSON(writer, http.StatusOK, env, request.Header)
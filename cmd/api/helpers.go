@@ -4,15 +4,20 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/config"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/pool"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/signing"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/storage"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/utils"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
@@ -42,20 +47,90 @@ func openDB(cfg config.Config) (*sql.DB, error) {
 	return db, nil
 }
 
-func (app *application) readProcessingOptions(w http.ResponseWriter, r *http.Request, opts *storage.ImageProcessingOption) {
-	queryString := r.URL.Query()
-	v := validator.New()
+func openStorage(cfg config.Config, processingPool *pool.Pool) (*storage.ImageStorage, error) {
+	var backend storage.Backend
 
+	switch cfg.Storage.Backend {
+	// .env files from before backends were pluggable don't set one
+	case "", "filesystem":
+		fs, err := storage.NewFileSystem(cfg.Upload.Path, cfg.Upload.TempPath)
+		if err != nil {
+			return nil, err
+		}
+		backend = fs
+	case "s3":
+		s3, err := storage.NewS3(storage.S3Options{
+			Endpoint:        cfg.S3.Endpoint,
+			Region:          cfg.S3.Region,
+			Bucket:          cfg.S3.Bucket,
+			AccessKeyID:     cfg.S3.AccessKeyID,
+			SecretAccessKey: cfg.S3.SecretAccessKey,
+			Prefix:          cfg.S3.Prefix,
+			TempPrefix:      cfg.S3.TempPrefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend = s3
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+
+	if cfg.Upload.MaxPixels <= 0 || cfg.Upload.MaxDimension <= 0 {
+		return nil, errors.New("upload max pixels and max dimension must be positive")
+	}
+
+	limits := storage.Limits{MaxPixels: cfg.Upload.MaxPixels, MaxDimension: cfg.Upload.MaxDimension}
+
+	policy := storage.UploadPolicy{StripMetadata: cfg.Upload.StripMetadata, Pool: processingPool}
+
+	return storage.New(backend, limits, policy), nil
+}
+
+func openProcessingPool(cfg config.Config) (*pool.Pool, error) {
+	timeout, err := time.ParseDuration(cfg.Processing.QueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.New(cfg.Processing.Concurrency, cfg.Processing.QueueDepth, timeout)
+}
+
+func openSigner(cfg config.Config) (*signing.Signer, error) {
+	if cfg.Signing.Keys == "" {
+		if cfg.Signing.Enabled {
+			return nil, errors.New("url signing is enabled but no signing keys are configured")
+		}
+		return nil, nil
+	}
+
+	keys, err := signing.ParseKeys(cfg.Signing.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return signing.New(keys, cfg.Signing.ActiveKey)
+}
+
+func (app *application) readProcessingOptions(queryString url.Values, opts *storage.ImageProcessingOption, v *validator.Validator) {
 	opts.Crop = app.readBool(queryString, "crop", v)
 	opts.Width = app.readInt(queryString, "w", 0, v)
 	opts.Height = app.readInt(queryString, "h", 0, v)
 	opts.Quality = app.readInt(queryString, "q", 100, v)
 	opts.BlurSigma = app.readFloat(queryString, "blur", 0, v)
+	opts.Format = app.readString(queryString, "fm", "")
 
-	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
+	// -1 keeps GIFs animated, it is what leaving frame out means
+	// rather than a value clients may send
+	opts.Frame = -1
+	if queryString.Get("frame") != "" {
+		opts.Frame = app.readInt(queryString, "frame", 0, v)
+		v.Check(opts.Frame >= 0, "frame", "cannot be less than 0")
 	}
+
+	opts.Fit = app.readString(queryString, "fit", "")
+	opts.Gravity = app.readString(queryString, "gravity", "")
+	opts.Ops = storage.ParseOperations(v, app.readString(queryString, "ops", ""))
 }
 
 func (app *application) getImageNameFromRequestContext(request *http.Request) (string, error) {
@@ -70,6 +145,17 @@ func (app *application) getImageNameFromRequestContext(request *http.Request) (s
 	return name, nil
 }
 
+func (app *application) readIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
+	}
+
+	return id, nil
+}
+
 type envelope map[string]interface{}
 
 func (app *application) writeJSON(writer http.ResponseWriter, code int, data envelope, headers http.Header) error {
@@ -91,6 +177,149 @@ func (app *application) writeJSON(writer http.ResponseWriter, code int, data env
 	return nil
 }
 
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+
+		case errors.As(err, &invalidUnmarshalError):
+			panic(err)
+
+		default:
+			return err
+		}
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// versionETag is the entity tag of a record, clients send it
+// back in If-Match to guard an update against lost writes.
+func versionETag(version int32) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatch reports whether the If-Match header, if any, matches the
+// record version. A missing header or "*" always matches.
+func ifMatch(r *http.Request, version int32) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == versionETag(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since against
+// the current representation, If-Modified-Since is only looked at when
+// If-None-Match is absent (RFC 9110, section 13.2.2).
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err == nil && !lastModified.Truncate(time.Second).After(since) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (app *application) readString(queryString url.Values, key string, defaultValue string) string {
+	value := queryString.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+func (app *application) readOptionalBool(queryString url.Values, key string, v *validator.Validator) *bool {
+	value := queryString.Get(key)
+	if value == "" {
+		return nil
+	}
+
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		v.AddError(key, fmt.Sprintf("%s must be a boolean value.", key))
+		return nil
+	}
+
+	return &res
+}
+
+// readTime accepts either a full RFC 3339 timestamp or a plain date (2006-01-02)
+func (app *application) readTime(queryString url.Values, key string, v *validator.Validator) *time.Time {
+	value := queryString.Get(key)
+	if value == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return &t
+		}
+	}
+
+	v.AddError(key, fmt.Sprintf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date.", key))
+	return nil
+}
+
 func (app *application) readBool(queryString url.Values, key string, v *validator.Validator) bool {
 
 	value := queryString.Get(key)
@@ -138,3 +367,21 @@ func (app *application) readFloat(queryString url.Values, key string, defaultVal
 func (application *application) generateImageURL(name string) string {
 	return fmt.Sprintf("http://%s:%d/v1/images/%s", application.config.Host, application.config.Port, name)
 }
+
+// background runs fn in a goroutine tracked by app.wg,
+// serve() waits for it to return before exiting.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
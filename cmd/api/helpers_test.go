@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/storage"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
+)
+
+func TestReadProcessingOptionsFrame(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		query     string
+		wantFrame int
+		wantValid bool
+	}{
+		{"", -1, true},
+		{"frame=0", 0, true},
+		{"frame=3", 3, true},
+		{"frame=-1", -1, false},
+		{"frame=-7", -7, false},
+		{"frame=first", 0, false},
+	}
+
+	for _, tt := range tests {
+		queryString, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", tt.query, err)
+		}
+
+		opts := &storage.ImageProcessingOption{}
+		v := validator.New()
+		app.readProcessingOptions(queryString, opts, v)
+
+		if opts.Frame != tt.wantFrame || v.Valid() != tt.wantValid {
+			t.Errorf("%q: got frame %d valid %t, want frame %d valid %t", tt.query, opts.Frame, v.Valid(), tt.wantFrame, tt.wantValid)
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image/gif"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/pool"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/storage"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
 )
@@ -20,7 +29,7 @@ func (app *application) uploadImagesHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	image, err := app.storage.Save(file, *fileHeader, true, app.config.Upload.TempPath, v)
+	image, err := app.storage.Save(file, *fileHeader, true, v)
 	if err != nil {
 		switch {
 		case errors.Is(err, storage.ErrUnsupportedFormat):
@@ -31,6 +40,10 @@ func (app *application) uploadImagesHandler(w http.ResponseWriter, r *http.Reque
 			app.serverErrorResponse(w, r, err)
 		case errors.Is(err, storage.ErrInvalidImage):
 			app.badRequestResponse(w, r, err)
+		case errors.Is(err, storage.ErrImageTooLarge):
+			app.imageTooLargeResponse(w, r, http.StatusRequestEntityTooLarge, err)
+		case errors.Is(err, pool.ErrSaturated):
+			app.serviceUnavailableResponse(w, r, app.pool.Timeout())
 		case errors.Is(err, storage.ErrValidation):
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
@@ -61,11 +74,85 @@ func (app *application) uploadImagesHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+func (app *application) listImagesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.ImageFilters
+		data.Filters
+	}
+
+	v := validator.New()
+	queryString := r.URL.Query()
+
+	input.Query = app.readString(queryString, "q", "")
+	input.MIMEType = app.readString(queryString, "mime_type", "")
+	input.IsTemp = app.readOptionalBool(queryString, "is_temp", v)
+	input.CreatedAfter = app.readTime(queryString, "created_after", v)
+	input.CreatedBefore = app.readTime(queryString, "created_before", v)
+	input.MinWidth = app.readInt(queryString, "min_width", 0, v)
+	input.MaxWidth = app.readInt(queryString, "max_width", 0, v)
+	input.MinHeight = app.readInt(queryString, "min_height", 0, v)
+	input.MaxHeight = app.readInt(queryString, "max_height", 0, v)
+
+	input.Filters.Page = app.readInt(queryString, "page", 1, v)
+	input.Filters.PageSize = app.readInt(queryString, "page_size", 20, v)
+	// best matches first when searching, newest first otherwise
+	defaultSort := "-created_at"
+	if input.Query != "" {
+		defaultSort = "-rank"
+	}
+
+	input.Filters.Sort = app.readString(queryString, "sort", defaultSort)
+	input.Filters.SortSafelist = []string{"created_at", "size", "name", "rank", "-created_at", "-size", "-name", "-rank"}
+
+	data.ValidateFilters(v, input.Filters)
+
+	if data.ValidateImageFilters(v, input.ImageFilters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	images, metadata, err := app.models.Images.GetAll(input.ImageFilters, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, image := range images {
+		image.URL = app.generateImageURL(image.Name)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"images": images, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) getImagesHandler(w http.ResponseWriter, r *http.Request) {
 
 	name, err := app.getImageNameFromRequestContext(r)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// checked before anything else, an unsigned request
+	// must not cost us a database query let alone a resize
+	if app.config.Signing.Enabled {
+		err = app.signer.Verify(r.URL.Path, r.URL.Query())
+		if err != nil {
+			app.invalidSignatureResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	opts := &storage.ImageProcessingOption{}
+
+	app.readProcessingOptions(r.URL.Query(), opts, v)
+
+	if storage.ValidateImageProcessingOption(v, opts); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
 	image, err := app.models.Images.GetByName(name)
@@ -79,39 +166,457 @@ func (app *application) getImagesHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	path, err := app.storage.GetFullPath(image)
+	opts.FocalPoint = image.FocalPoint
+
+	// how much work an ops chain is depends on the image it runs on
+	if storage.ValidatePipelineCost(v, opts.Ops, int(image.Width), int(image.Height)); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept") // the output format is negotiated
+
+	format, err := storage.OutputFormat(r.Header.Get("Accept"), image, opts)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.notAcceptableResponse(w, r, err)
 		return
 	}
 
-	opts := &storage.ImageProcessingOption{}
-	app.readProcessingOptions(w, r, opts)
+	// everything a client needs to revalidate is known without
+	// touching the file, a 304 costs no decoding at all
+	etag := variantETag(image, opts, format)
+	app.setImageCacheHeaders(w, r, image, etag)
+
+	if notModified(r, etag, image.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, err := app.renderImage(image, opts, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, pool.ErrSaturated):
+			app.serviceUnavailableResponse(w, r, app.pool.Timeout())
+		case errors.Is(err, storage.ErrImageTooLarge):
+			app.imageTooLargeResponse(w, r, http.StatusUnprocessableEntity, err)
+		case errors.Is(err, storage.ErrFrameOutOfRange):
+			app.failedValidationResponse(w, r, map[string]string{"frame": err.Error()})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	storage.SetImageHeaders(w, image.Name+storage.EXT_MAP[format], format)
+	w.Write(content)
+}
+
+// getOriginalImageHandler streams the stored file untouched. Range,
+// HEAD and conditional requests are left to http.ServeContent.
+func (app *application) getOriginalImageHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
 
 	v := validator.New()
 
-	if storage.ValidateImageProcessingOption(v, opts); !v.Valid() {
+	download := app.readBool(r.URL.Query(), "download", v)
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	img, err := storage.ProcessImage(path, opts)
+	image, err := app.models.Images.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	file, err := app.storage.Open(image)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrFileNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	fileName := image.Name + storage.EXT_MAP[image.MIMEType]
+
+	storage.SetImageHeaders(w, fileName, image.MIMEType)
+	if download {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+	}
+
+	app.setImageCacheHeaders(w, r, image, originalETag(image))
+
+	http.ServeContent(w, r, fileName, image.UpdatedAt, file)
+}
+
+// renderImage returns image processed with opts and encoded as format,
+// served from the variant cache when it has been rendered before.
+func (app *application) renderImage(image *data.Image, opts *storage.ImageProcessingOption, format string) ([]byte, error) {
+	return app.renderVariant(image.Name, variantCacheKey(image, opts, format), func() ([]byte, error) {
+		file, err := app.storage.Open(image)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		buf := new(bytes.Buffer)
+
+		// GIF to GIF keeps the animation unless a single frame or an
+		// ops chain is asked for, ops render a still of the first frame
+		if image.MIMEType == "image/gif" && format == "image/gif" && opts.Frame < 0 && len(opts.Ops) == 0 {
+			anim, err := storage.ProcessGIF(file, opts, app.storage.Limits())
+			if err != nil {
+				return nil, err
+			}
+
+			err = gif.EncodeAll(buf, anim)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			img, err := storage.ProcessImage(file, opts, app.storage.Limits())
+			if err != nil {
+				return nil, err
+			}
+
+			err = storage.Encode(buf, img, format, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return buf.Bytes(), nil
+	})
+}
+
+// renderVariant returns the variant key of the image name from the
+// cache, or renders and caches it. Concurrent calls for the same
+// variant share a single render.
+func (app *application) renderVariant(name, key string, render func() ([]byte, error)) ([]byte, error) {
+	if app.cache != nil {
+		if content, ok := app.cache.Get(name, key); ok {
+			return content, nil
+		}
+	}
+
+	// every caller gets the same slice, it must not be modified
+	flight := app.renders.DoChan(name+"/"+key, func() (val interface{}, err error) {
+		// the render runs on a goroutine of its own, a panic would
+		// take the whole server down rather than just this request
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("render panicked: %v", p)
+			}
+		}()
+
+		// a flight for this variant may have finished
+		// between the cache lookup above and now
+		if app.cache != nil {
+			if content, ok := app.cache.Get(name, key); ok {
+				return content, nil
+			}
+		}
+
+		// decoding and resizing is what eats CPU and memory,
+		// only a bounded number of renders run at a time
+		err = app.pool.Acquire()
+		if err != nil {
+			return nil, err
+		}
+		defer app.pool.Release()
+
+		content, err := render()
+		if err != nil {
+			return nil, err
+		}
+
+		if app.cache != nil {
+			// a failed write only costs us a re-render next time
+			err := app.cache.Set(name, key, content)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"image": name})
+			}
+		}
+
+		return content, nil
+	})
+
+	if app.renderJoined != nil {
+		app.renderJoined()
+	}
+
+	result := <-flight
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	return result.Val.([]byte), nil
+}
+
+// variantCacheKey identifies a rendered variant. The version is part of
+// it so a replica that missed an invalidation never serves stale bytes.
+func variantCacheKey(image *data.Image, opts *storage.ImageProcessingOption, format string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s", image.Version, opts.Canonical(), format)))
+	return hex.EncodeToString(sum[:]) + storage.EXT_MAP[format]
+}
+
+// variantETag is a strong entity tag for a rendered variant, it changes
+// whenever the image version, the options or the output format do.
+func variantETag(image *data.Image, opts *storage.ImageProcessingOption, format string) string {
+	return `"` + variantCacheKey(image, opts, format)[:32] + `"`
+}
+
+// originalETag is a strong entity tag for the stored file.
+func originalETag(image *data.Image) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|original", image.Version)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func (app *application) setImageCacheHeaders(w http.ResponseWriter, r *http.Request, image *data.Image, etag string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", image.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	// a URL pinned to the current version never changes, a newer
+	// version gets a new URL, so it can be cached forever
+	if r.URL.Query().Get("v") == strconv.Itoa(int(image.Version)) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		return
+	}
+
+	if app.config.HTTPCache.CacheControl != "" {
+		w.Header().Set("Cache-Control", app.config.HTTPCache.CacheControl)
+	}
+}
+
+// invalidateVariants drops every cached variant of image,
+// called whenever the image is changed or deleted.
+func (app *application) invalidateVariants(image *data.Image) {
+	if app.cache == nil {
+		return
+	}
+
+	err := app.cache.Invalidate(image.Name)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"image": image.Name})
+	}
+}
+
+func (app *application) getImagesMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	image, err := app.models.Images.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	image.URL = app.generateImageURL(image.Name)
+
+	metadata := image.Metadata
+	if app.config.Metadata.RedactGPS {
+		metadata.GPS = nil
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(image.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"image": image, "metadata": metadata}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateImageHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	image, err := app.models.Images.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = storage.EncodeImage(w, r, img, opts, image)
+	// pointers tell fields left out of the body apart from zero values,
+	// the focal point stays raw so an explicit null can clear it
+	var input struct {
+		Alt        *string         `json:"alt"`
+		FocalPoint json.RawMessage `json:"focal_point"`
+		Version    *int32          `json:"version"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// the client may pin the version it read either through If-Match
+	// or in the body, a mismatch means someone else updated it first
+	if !ifMatch(r, image.Version) || (input.Version != nil && *input.Version != image.Version) {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Alt != nil {
+		image.Alt = *input.Alt
+	}
+
+	switch {
+	case input.FocalPoint == nil:
+	case bytes.Equal(input.FocalPoint, []byte("null")):
+		image.FocalPoint = nil
+	default:
+		var focalPoint data.FocalPoint
+		if err := json.Unmarshal(input.FocalPoint, &focalPoint); err != nil {
+			app.badRequestResponse(w, r, errors.New("body contains incorrect JSON type for field \"focal_point\""))
+			return
+		}
+		image.FocalPoint = &focalPoint
+	}
+
+	v := validator.New()
+
+	if data.ValidateImage(v, image); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	image.UpdatedAt = time.Now()
+
+	err = app.models.Images.Update(image)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateVariants(image)
+
+	image.URL = app.generateImageURL(image.Name)
+
+	metadata := image.Metadata
+	if app.config.Metadata.RedactGPS {
+		metadata.GPS = nil
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(image.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"image": image, "metadata": metadata}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) commitImageHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	image, err := app.models.Images.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
+
+	// committing twice is a no-op, makes retrying after a failure safe
+	if image.IsTemp {
+		// the row is claimed before the file is touched, bumping its
+		// version makes a janitor sweep that read it earlier conflict
+		// instead of purging a file that is being committed. If the
+		// sweep got there first the claim conflicts and nothing moves.
+		image.UpdatedAt = time.Now()
+
+		err = app.models.Images.Update(image)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// file next, a crash before the row is updated leaves a temp
+		// record whose file is already permanent, which storage.Open
+		// still finds and a retried commit finishes
+		err = app.storage.Commit(image)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		image.IsTemp = false
+		image.UpdatedAt = time.Now()
+
+		err = app.models.Images.Update(image)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	image.URL = app.generateImageURL(image.Name)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"image": image}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
-func (app *application) getImagesMetadataHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) deleteImageHandler(w http.ResponseWriter, r *http.Request) {
 	name, err := app.getImageNameFromRequestContext(r)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	image, err := app.models.Images.GetByName(name)
@@ -125,9 +630,130 @@ func (app *application) getImagesMetadataHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// only the row is touched, the file stays until
+	// the janitor purges the trash
+	err = app.models.Images.SoftDelete(image)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateVariants(image)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "image successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) restoreImageHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	image, err := app.models.Images.GetDeletedByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Images.Restore(image)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	image.URL = app.generateImageURL(image.Name)
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"image": image}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"image": image}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) signImageURLHandler(w http.ResponseWriter, r *http.Request) {
+	if app.signer == nil {
+		app.signingUnavailableResponse(w, r)
+		return
+	}
+
+	name, err := app.getImageNameFromRequestContext(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Params map[string]string `json:"params"`
+		TTL    string            `json:"ttl"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.TTL == "" {
+		input.TTL = app.config.Signing.TTL
+	}
+
+	v := validator.New()
+
+	ttl, err := time.ParseDuration(input.TTL)
+	v.Check(err == nil, "ttl", "must be a duration (e.g., '24h')")
+	v.Check(err != nil || ttl > 0, "ttl", "must be positive")
+
+	query := url.Values{}
+	for key, value := range input.Params {
+		query.Set(key, value)
+	}
+
+	// only URLs that would actually be served are worth signing
+	opts := &storage.ImageProcessingOption{}
+	app.readProcessingOptions(query, opts, v)
+
+	if storage.ValidateImageProcessingOption(v, opts); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Images.GetByName(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	signed := app.signer.Sign("/v1/images/"+name, query, ttl)
+
+	env := envelope{
+		"url":        app.generateImageURL(name) + "?" + signed.Encode(),
+		"expires_at": time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/pool"
+)
+
+func TestRenderVariantCollapsesConcurrentRequests(t *testing.T) {
+	p, err := pool.New(1, 0, time.Second)
+	if err != nil {
+		t.Fatalf("cannot initialize pool: %v", err)
+	}
+	app := &application{pool: p}
+
+	var renders atomic.Int32
+	release := make(chan struct{})
+
+	render := func() ([]byte, error) {
+		renders.Add(1)
+		<-release
+		return []byte("rendered variant"), nil
+	}
+
+	const requests = 20
+
+	// the render is held until every request has started or joined it
+	var joined, done sync.WaitGroup
+	joined.Add(requests)
+	app.renderJoined = joined.Done
+
+	results := make([][]byte, requests)
+	errs := make([]error, requests)
+
+	for i := 0; i < requests; i++ {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			results[i], errs[i] = app.renderVariant("cat-123", "variant", render)
+		}(i)
+	}
+
+	joined.Wait()
+	close(release)
+	done.Wait()
+
+	if n := renders.Load(); n != 1 {
+		t.Fatalf("expected a single render, got %d", n)
+	}
+
+	for i := 0; i < requests; i++ {
+		if errs[i] != nil {
+			t.Fatalf("request %d failed: %v", i, errs[i])
+		}
+		if !bytes.Equal(results[i], []byte("rendered variant")) {
+			t.Fatalf("request %d got %q", i, results[i])
+		}
+	}
+
+	// a different variant is rendered on its own
+	app.renderJoined = nil
+	if _, err := app.renderVariant("cat-123", "other", render); err != nil || renders.Load() != 2 {
+		t.Fatalf("expected a second render for another variant, got %d renders and %v", renders.Load(), err)
+	}
+}
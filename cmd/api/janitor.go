@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/config"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+)
+
+// rows fetched per query, a sweep keeps going until a batch comes back short
+const janitorBatchSize = 500
+
+type janitorStats struct {
+	LastRun             time.Time `json:"last_run"`
+	Duration            string    `json:"duration"`
+	TempImagesDeleted   int       `json:"temp_images_deleted"`
+	TrashedImagesPurged int       `json:"trashed_images_purged"`
+	OrphanFilesDeleted  int       `json:"orphan_files_deleted"`
+	Errors              int       `json:"errors"`
+}
+
+type janitor struct {
+	interval       time.Duration
+	tempTTL        time.Duration
+	trashRetention time.Duration
+
+	mu    sync.Mutex
+	stats *janitorStats // nil until the first sweep finishes
+}
+
+func newJanitor(cfg config.Config) (*janitor, error) {
+	interval, err := time.ParseDuration(cfg.Janitor.Interval)
+	if err != nil {
+		return nil, err
+	}
+
+	tempTTL, err := time.ParseDuration(cfg.Janitor.TempTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	trashRetention, err := time.ParseDuration(cfg.Janitor.TrashRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 || tempTTL <= 0 || trashRetention <= 0 {
+		return nil, errors.New("janitor interval, temp ttl and trash retention must be positive")
+	}
+
+	return &janitor{interval: interval, tempTTL: tempTTL, trashRetention: trashRetention}, nil
+}
+
+func (j *janitor) Stats() *janitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.stats == nil {
+		return nil
+	}
+
+	stats := *j.stats
+	return &stats
+}
+
+// runJanitor sweeps once right away and then every interval
+// until ctx is cancelled.
+func (app *application) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(app.janitor.interval)
+	defer ticker.Stop()
+
+	for {
+		app.sweep()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) sweep() {
+	stats := &janitorStats{LastRun: time.Now()}
+	cutoff := stats.LastRun.Add(-app.janitor.tempTTL)
+
+	app.sweepTempImages(cutoff, stats)
+	app.sweepTrash(stats.LastRun.Add(-app.janitor.trashRetention), stats)
+	app.sweepOrphanFiles(cutoff, stats)
+
+	stats.Duration = time.Since(stats.LastRun).String()
+
+	app.janitor.mu.Lock()
+	app.janitor.stats = stats
+	app.janitor.mu.Unlock()
+
+	app.logger.PrintInfo("janitor sweep completed", map[string]string{
+		"temp_images_deleted":   strconv.Itoa(stats.TempImagesDeleted),
+		"trashed_images_purged": strconv.Itoa(stats.TrashedImagesPurged),
+		"orphan_files_deleted":  strconv.Itoa(stats.OrphanFilesDeleted),
+		"errors":                strconv.Itoa(stats.Errors),
+		"duration":              stats.Duration,
+	})
+}
+
+func (app *application) sweepTempImages(cutoff time.Time, stats *janitorStats) {
+	for {
+		images, err := app.models.Images.GetExpiredTemp(cutoff, janitorBatchSize)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			stats.Errors++
+			return
+		}
+
+		deleted := 0
+		for _, image := range images {
+			// row goes first, if the image got committed in the meantime
+			// the delete conflicts and its file is left alone. A commit
+			// bumps the version before it moves the file, so once the
+			// delete went through no commit can be touching it.
+			err := app.models.Images.DeleteTemp(image)
+			if err != nil {
+				if !errors.Is(err, data.ErrEditConflict) {
+					app.logger.PrintError(err, map[string]string{"image": image.Name})
+					stats.Errors++
+				}
+				continue
+			}
+
+			// a failure here leaves an orphan file which
+			// sweepOrphanFiles picks up on a later run
+			err = app.storage.Purge(image)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"image": image.Name})
+				stats.Errors++
+			}
+
+			deleted++
+			stats.TempImagesDeleted++
+		}
+
+		// nothing could be deleted, the next batch would be the same one
+		if len(images) < janitorBatchSize || deleted == 0 {
+			return
+		}
+	}
+}
+
+// sweepTrash purges images that were deleted before cutoff,
+// once purged they can no longer be restored.
+func (app *application) sweepTrash(cutoff time.Time, stats *janitorStats) {
+	for {
+		images, err := app.models.Images.GetExpiredDeleted(cutoff, janitorBatchSize)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			stats.Errors++
+			return
+		}
+
+		purged := 0
+		for _, image := range images {
+			// same ordering as sweepTempImages, a restore that
+			// slipped in between makes the delete conflict
+			err := app.models.Images.DeleteTrashed(image)
+			if err != nil {
+				if !errors.Is(err, data.ErrEditConflict) {
+					app.logger.PrintError(err, map[string]string{"image": image.Name})
+					stats.Errors++
+				}
+				continue
+			}
+
+			err = app.storage.Purge(image)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"image": image.Name})
+				stats.Errors++
+			}
+
+			purged++
+			stats.TrashedImagesPurged++
+		}
+
+		if len(images) < janitorBatchSize || purged == 0 {
+			return
+		}
+	}
+}
+
+// sweepOrphanFiles removes expired files that no image row points
+// to anymore, left behind when a purge failed after its row was gone.
+func (app *application) sweepOrphanFiles(cutoff time.Time, stats *janitorStats) {
+	for _, isTemp := range []bool{true, false} {
+		files, err := app.storage.List(isTemp)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			stats.Errors++
+			continue
+		}
+
+		for start := 0; start < len(files); start += janitorBatchSize {
+			end := min(start+janitorBatchSize, len(files))
+
+			fileNames := []string{}
+			for _, file := range files[start:end] {
+				if file.ModTime.Before(cutoff) {
+					fileNames = append(fileNames, file.Name)
+				}
+			}
+
+			if len(fileNames) == 0 {
+				continue
+			}
+
+			inUse, err := app.models.Images.FileNamesInUse(fileNames)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				stats.Errors++
+				break
+			}
+
+			for _, fileName := range fileNames {
+				if inUse[fileName] {
+					continue
+				}
+
+				err := app.storage.DeleteFile(fileName, isTemp)
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"file": fileName})
+					stats.Errors++
+					continue
+				}
+
+				stats.OrphanFilesDeleted++
+			}
+		}
+	}
+}
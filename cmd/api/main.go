@@ -5,12 +5,16 @@ import (
 	"os"
 	"sync"
 
+	"github.com/mnabil1718/blog.mnabil.dev/internal/cache"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/config"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/jsonlog"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/mailer"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/pool"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/signing"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/storage"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -23,7 +27,15 @@ type application struct {
 	models  data.Models
 	wg      sync.WaitGroup
 	mailer  mailer.Mailer
-	storage storage.ImageStorage
+	storage *storage.ImageStorage
+	janitor *janitor
+	signer  *signing.Signer
+	cache   *cache.Disk // nil when caching is disabled
+	renders singleflight.Group
+	// renderJoined is called once a request has started or joined a
+	// render, tests use it to line up concurrent requests
+	renderJoined func()
+	pool         *pool.Pool
 }
 
 func main() {
@@ -32,6 +44,7 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	config.SetConfigDefaultValues()
 	viper.SetConfigFile(".env")
 	viper.AutomaticEnv()
 	if err := viper.ReadInConfig(); err != nil {
@@ -56,7 +69,30 @@ func main() {
 
 	logger.PrintInfo("database connection pool established successfully.", nil)
 
-	storage, err := storage.New(cfg.Upload.Path, cfg.Upload.TempPath)
+	processingPool, err := openProcessingPool(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	storage, err := openStorage(cfg, processingPool)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	var variantCache *cache.Disk
+	if cfg.Cache.Enabled {
+		variantCache, err = cache.New(cfg.Cache.Path, cfg.Cache.MaxBytes)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	signer, err := openSigner(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	janitor, err := newJanitor(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
@@ -66,7 +102,11 @@ func main() {
 		config:  cfg,
 		models:  data.NewModels(db),
 		mailer:  mailer.New(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Sender),
-		storage: *storage,
+		storage: storage,
+		janitor: janitor,
+		signer:  signer,
+		cache:   variantCache,
+		pool:    processingPool,
 	}
 
 	err = app.serve()
@@ -13,9 +13,27 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
+	router.HandlerFunc(http.MethodGet, "/v1/images", app.listImagesHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/images/:name", app.getImagesHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/images/:name/metadata", app.getImagesMetadataHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/images", app.uploadImagesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/images/:name/original", app.getOriginalImageHandler)
+	router.HandlerFunc(http.MethodHead, "/v1/images/:name/original", app.getOriginalImageHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/images", app.requirePermission("images:write", app.uploadImagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/images/:name/commit", app.requirePermission("images:write", app.commitImageHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/images/:name", app.requirePermission("images:write", app.updateImageHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/images/:name", app.requirePermission("images:write", app.deleteImageHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/images/:name/restore", app.requirePermission("images:write", app.restoreImageHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/images/:name/sign", app.requirePermission("images:write", app.signImageURLHandler))
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(router)))
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireAuthenticationToken(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireAuthenticationToken(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireAuthenticationToken(app.revokeAPIKeyHandler))
+
+	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 }
@@ -24,6 +24,14 @@ func (app *application) serve() error {
 
 	shutDownErr := make(chan error)
 
+	// cancelled on shutdown, tells long running background workers to stop
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	app.background(func() {
+		app.runJanitor(workerCtx)
+	})
+
 	// runs in the background waiting for syscall
 	go func() {
 		quit := make(chan os.Signal, 1) //  buffered channel, 1 empty slot ready to receive 1 data (signal)
@@ -49,6 +57,7 @@ func (app *application) serve() error {
 			"addr": server.Addr,
 		})
 
+		stopWorkers()
 		app.wg.Wait()
 		shutDownErr <- nil
 	}()
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"time"
 )
 
 func generateCSRFKey() string {
@@ -15,7 +16,20 @@ func generateCSRFKey() string {
 	return base64.StdEncoding.EncodeToString(key)
 }
 
+// generateSigningKey returns a key in the id:secret format SIGNING_KEYS
+// expects, the id is the creation date so rotated keys are easy to tell apart
+func generateSigningKey() string {
+	secret := generateCSRFKey()
+	if secret == "" {
+		return ""
+	}
+	return fmt.Sprintf("k%s:%s", time.Now().Format("20060102"), secret)
+}
+
 func main() {
 	key := generateCSRFKey()
 	fmt.Println("Generated CSRF Key:", key)
+
+	signingKey := generateSigningKey()
+	fmt.Println("Generated URL Signing Key:", signingKey)
 }
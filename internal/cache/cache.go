@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Disk is a size capped cache of byte blobs stored as files under a
+// directory, the least recently used entries are evicted first.
+// Entries belong to a group (one directory each) so everything
+// derived from the same source can be dropped at once.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	path string // relative to dir, "<group>/<key>"
+	size int64
+}
+
+// New opens the cache in dir, files left over from a previous run
+// are picked up again with their modification time as last use.
+func New(dir string, maxBytes int64) (*Disk, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	c := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry
+		modTime int64
+	}
+	files := []found{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		// half written files of a crashed Set
+		if strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, found{entry{filepath.ToSlash(rel), info.Size()}, info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime > files[j].modTime })
+
+	for _, file := range files {
+		e := file.entry
+		c.entries[e.path] = c.lru.PushBack(&e)
+		c.size += e.size
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+func (c *Disk) Get(group, key string) ([]byte, bool) {
+	path, err := entryPath(group, key)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	element, ok := c.entries[path]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	value, err := os.ReadFile(filepath.Join(c.dir, path))
+	if err != nil {
+		// removed behind our back, forget about it
+		c.mu.Lock()
+		if element, ok := c.entries[path]; ok {
+			c.remove(element)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	return value, true
+}
+
+func (c *Disk) Set(group, key string, value []byte) error {
+	path, err := entryPath(group, key)
+	if err != nil {
+		return err
+	}
+
+	if int64(len(value)) > c.maxBytes {
+		return nil // would evict everything else and then itself
+	}
+
+	full := filepath.Join(c.dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	// write then rename, readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(full), "*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[path]; ok {
+		c.size -= element.Value.(*entry).size
+		c.lru.Remove(element)
+	}
+
+	c.entries[path] = c.lru.PushFront(&entry{path, int64(len(value))})
+	c.size += int64(len(value))
+	c.evict()
+
+	return nil
+}
+
+// Invalidate drops every entry of group.
+func (c *Disk) Invalidate(group string) error {
+	if err := validateSegment(group); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := group + "/"
+	for path, element := range c.entries {
+		if strings.HasPrefix(path, prefix) {
+			c.size -= element.Value.(*entry).size
+			c.lru.Remove(element)
+			delete(c.entries, path)
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(c.dir, group))
+}
+
+// Size returns the number of entries and their total size in bytes.
+func (c *Disk) Size() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries), c.size
+}
+
+// evict must be called with c.mu held.
+func (c *Disk) evict() {
+	for c.size > c.maxBytes {
+		element := c.lru.Back()
+		if element == nil {
+			return
+		}
+
+		path := element.Value.(*entry).path
+		c.remove(element)
+		os.Remove(filepath.Join(c.dir, path))
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *Disk) remove(element *list.Element) {
+	e := element.Value.(*entry)
+	c.size -= e.size
+	c.lru.Remove(element)
+	delete(c.entries, e.path)
+}
+
+func entryPath(group, key string) (string, error) {
+	if err := validateSegment(group); err != nil {
+		return "", err
+	}
+
+	if err := validateSegment(key); err != nil {
+		return "", err
+	}
+
+	return group + "/" + key, nil
+}
+
+// validateSegment keeps groups and keys from escaping the cache directory
+func validateSegment(segment string) error {
+	if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, `/\`) || strings.HasSuffix(segment, ".tmp") {
+		return fmt.Errorf("invalid cache path segment %q", segment)
+	}
+
+	return nil
+}
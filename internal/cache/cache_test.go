@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiskEvictsLeastRecentlyUsed(t *testing.T) {
+	c, err := New(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("cannot initialize cache: %v", err)
+	}
+
+	c.Set("a", "1", []byte("aaaa"))
+	c.Set("b", "1", []byte("bbbb"))
+
+	// touch a so b becomes the least recently used entry
+	if _, ok := c.Get("a", "1"); !ok {
+		t.Fatalf("expected a cache hit for a")
+	}
+
+	c.Set("c", "1", []byte("cccc"))
+
+	if _, ok := c.Get("b", "1"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+
+	value, ok := c.Get("a", "1")
+	if !ok || !bytes.Equal(value, []byte("aaaa")) {
+		t.Fatalf("expected a to survive eviction, got %q", value)
+	}
+
+	if entries, size := c.Size(); entries != 2 || size != 8 {
+		t.Fatalf("unexpected size: %d entries, %d bytes", entries, size)
+	}
+}
+
+func TestDiskInvalidateAndReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	c, _ := New(dir, 100)
+	c.Set("cat", "small", []byte("1"))
+	c.Set("cat", "large", []byte("22"))
+	c.Set("dog", "small", []byte("333"))
+
+	if err := c.Invalidate("cat"); err != nil {
+		t.Fatalf("cannot invalidate: %v", err)
+	}
+
+	if _, ok := c.Get("cat", "small"); ok {
+		t.Fatalf("expected cat entries to be gone")
+	}
+
+	reopened, err := New(dir, 100)
+	if err != nil {
+		t.Fatalf("cannot reopen cache: %v", err)
+	}
+
+	if value, ok := reopened.Get("dog", "small"); !ok || string(value) != "333" {
+		t.Fatalf("expected dog entry to survive a reopen, got %q", value)
+	}
+
+	if entries, _ := reopened.Size(); entries != 1 {
+		t.Fatalf("expected 1 entry after reopen, got %d", entries)
+	}
+}
+
+func TestDiskRejectsPathTraversal(t *testing.T) {
+	c, _ := New(t.TempDir(), 100)
+
+	if err := c.Set("..", "x", []byte("1")); err == nil {
+		t.Fatalf("expected an error for group ..")
+	}
+
+	if err := c.Set("a", "../x", []byte("1")); err == nil {
+		t.Fatalf("expected an error for key ../x")
+	}
+}
@@ -37,10 +37,60 @@ type Config struct {
 		TrustedOrigins []string `mapstructure:"CORS_TRUSTED_ORIGINS" doc:"Space-separated list of trusted origins for CORS."`
 	} `doc:"CORS configuration."`
 
+	Storage struct {
+		Backend string `mapstructure:"STORAGE_BACKEND" doc:"The storage backend for image files (e.g., filesystem, s3)."`
+	} `doc:"Storage backend configuration."`
+
+	S3 struct {
+		Endpoint        string `mapstructure:"S3_ENDPOINT" doc:"The S3-compatible endpoint URL, requests are path-style."`
+		Region          string `mapstructure:"S3_REGION" doc:"The region used when signing requests."`
+		Bucket          string `mapstructure:"S3_BUCKET" doc:"The bucket image files are stored in."`
+		AccessKeyID     string `mapstructure:"S3_ACCESS_KEY_ID" doc:"The access key ID for authentication."`
+		SecretAccessKey string `mapstructure:"S3_SECRET_ACCESS_KEY" doc:"The secret access key for authentication."`
+		Prefix          string `mapstructure:"S3_PREFIX" doc:"The key prefix for permanent file uploads."`
+		TempPrefix      string `mapstructure:"S3_TEMP_PREFIX" doc:"The key prefix for temporary file uploads."`
+	} `doc:"S3 storage backend configuration."`
+
 	Upload struct {
-		Path     string `mapstructure:"UPLOAD_PATH" doc:"The directory path for permanent file uploads."`
-		TempPath string `mapstructure:"UPLOAD_TEMP_PATH" doc:"The directory path for temporary file uploads."`
+		Path          string `mapstructure:"UPLOAD_PATH" doc:"The directory path for permanent file uploads."`
+		TempPath      string `mapstructure:"UPLOAD_TEMP_PATH" doc:"The directory path for temporary file uploads."`
+		MaxPixels     int64  `mapstructure:"UPLOAD_MAX_PIXELS" doc:"The maximum width times height of an image, checked before it is ever decoded."`
+		MaxDimension  int    `mapstructure:"UPLOAD_MAX_DIMENSION" doc:"The maximum width or height of an image in pixels."`
+		StripMetadata bool   `mapstructure:"UPLOAD_STRIP_METADATA" doc:"Whether EXIF, XMP and IPTC metadata is removed from originals, with the orientation baked in."`
 	} `doc:"File upload configuration."`
+
+	Processing struct {
+		Concurrency  int    `mapstructure:"PROCESSING_CONCURRENCY" doc:"The maximum number of images processed at the same time."`
+		QueueDepth   int    `mapstructure:"PROCESSING_QUEUE_DEPTH" doc:"How many requests may wait for a free processing slot before new ones are rejected."`
+		QueueTimeout string `mapstructure:"PROCESSING_QUEUE_TIMEOUT" doc:"How long a request waits for a free processing slot (e.g., '10s')."`
+	} `doc:"Image processing limits."`
+
+	Metadata struct {
+		RedactGPS bool `mapstructure:"METADATA_REDACT_GPS" doc:"Whether the GPS position is left out when serving the metadata of an image."`
+	} `doc:"Image metadata configuration."`
+
+	HTTPCache struct {
+		CacheControl string `mapstructure:"HTTP_CACHE_CONTROL" doc:"The Cache-Control header of processed images, URLs pinned to the current version with v= are always immutable."`
+	} `doc:"HTTP caching configuration."`
+
+	Cache struct {
+		Enabled  bool   `mapstructure:"CACHE_ENABLED" doc:"Whether processed image variants are cached on disk."`
+		Path     string `mapstructure:"CACHE_PATH" doc:"The directory path for cached image variants."`
+		MaxBytes int64  `mapstructure:"CACHE_MAX_BYTES" doc:"The maximum total size of the cache in bytes, least recently used variants are evicted first."`
+	} `doc:"Processed image cache configuration."`
+
+	Signing struct {
+		Enabled   bool   `mapstructure:"SIGNING_ENABLED" doc:"Whether image processing URLs have to be signed."`
+		Keys      string `mapstructure:"SIGNING_KEYS" doc:"Space-separated list of id:base64-secret signing keys, all of them are accepted."`
+		ActiveKey string `mapstructure:"SIGNING_ACTIVE_KEY" doc:"The id of the key new URLs are signed with."`
+		TTL       string `mapstructure:"SIGNING_URL_TTL" doc:"How long a signed URL stays valid by default (e.g., '24h')."`
+	} `doc:"Signed URL configuration."`
+
+	Janitor struct {
+		Interval       string `mapstructure:"JANITOR_INTERVAL" doc:"How often abandoned temp uploads are swept (e.g., '10m')."`
+		TempTTL        string `mapstructure:"JANITOR_TEMP_TTL" doc:"How long an uncommitted temp upload is kept before it expires (e.g., '24h')."`
+		TrashRetention string `mapstructure:"JANITOR_TRASH_RETENTION" doc:"How long a deleted image can be restored before it is purged (e.g., '720h')."`
+	} `doc:"Background janitor configuration."`
 }
 
 func SetConfigDefaultValues() {
@@ -49,7 +99,6 @@ func SetConfigDefaultValues() {
 	viper.SetDefault("ENV", "development")
 	viper.SetDefault("FRONTEND_URL", "http://localhost:3000")
 
-	viper.SetDefault("DB_BLOG_DSN", "user:password@tcp(localhost:3306)/blogdb")
 	viper.SetDefault("DB_MAX_OPEN_CONNS", 25)
 	viper.SetDefault("DB_MAX_IDLE_CONNS", 25)
 	viper.SetDefault("DB_MAX_IDLE_TIME", "15m")
@@ -65,8 +114,39 @@ func SetConfigDefaultValues() {
 	viper.SetDefault("SMTP_SENDER", "Example <noreply@example.com>")
 
 	viper.SetDefault("CORS_TRUSTED_ORIGINS", "http://localhost:3000 http://localhost:8080")
+	viper.SetDefault("STORAGE_BACKEND", "filesystem")
+	viper.SetDefault("S3_ENDPOINT", "http://localhost:9000")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_BUCKET", "images")
+	viper.SetDefault("S3_PREFIX", "upload/")
+	viper.SetDefault("S3_TEMP_PREFIX", "temp/")
+
 	viper.SetDefault("UPLOAD_PATH", "./upload")
 	viper.SetDefault("UPLOAD_TEMP_PATH", "./temp")
+	viper.SetDefault("UPLOAD_MAX_PIXELS", 50_000_000)
+	viper.SetDefault("UPLOAD_MAX_DIMENSION", 10000)
+	viper.SetDefault("UPLOAD_STRIP_METADATA", true)
+
+	viper.SetDefault("PROCESSING_CONCURRENCY", 4)
+	viper.SetDefault("PROCESSING_QUEUE_DEPTH", 32)
+	viper.SetDefault("PROCESSING_QUEUE_TIMEOUT", "10s")
+
+	viper.SetDefault("METADATA_REDACT_GPS", true)
+
+	viper.SetDefault("HTTP_CACHE_CONTROL", "public, max-age=86400")
+
+	viper.SetDefault("CACHE_ENABLED", true)
+	viper.SetDefault("CACHE_PATH", "./cache")
+	viper.SetDefault("CACHE_MAX_BYTES", 1024*1024*1024)
+
+	viper.SetDefault("SIGNING_ENABLED", false)
+	viper.SetDefault("SIGNING_KEYS", "")
+	viper.SetDefault("SIGNING_ACTIVE_KEY", "")
+	viper.SetDefault("SIGNING_URL_TTL", "24h")
+
+	viper.SetDefault("JANITOR_INTERVAL", "10m")
+	viper.SetDefault("JANITOR_TEMP_TTL", "24h")
+	viper.SetDefault("JANITOR_TRASH_RETENTION", "720h")
 }
 
 func LoadConfig(cfg *Config) error {
@@ -91,8 +171,42 @@ func LoadConfig(cfg *Config) error {
 	cfg.SMTP.Password = viper.GetString("SMTP_PASSWORD")
 	cfg.SMTP.Sender = viper.GetString("SMTP_SENDER")
 
+	cfg.Storage.Backend = viper.GetString("STORAGE_BACKEND")
+
+	cfg.S3.Endpoint = viper.GetString("S3_ENDPOINT")
+	cfg.S3.Region = viper.GetString("S3_REGION")
+	cfg.S3.Bucket = viper.GetString("S3_BUCKET")
+	cfg.S3.AccessKeyID = viper.GetString("S3_ACCESS_KEY_ID")
+	cfg.S3.SecretAccessKey = viper.GetString("S3_SECRET_ACCESS_KEY")
+	cfg.S3.Prefix = viper.GetString("S3_PREFIX")
+	cfg.S3.TempPrefix = viper.GetString("S3_TEMP_PREFIX")
+
 	cfg.Upload.Path = viper.GetString("UPLOAD_PATH")
 	cfg.Upload.TempPath = viper.GetString("UPLOAD_TEMP_PATH")
+	cfg.Upload.MaxPixels = viper.GetInt64("UPLOAD_MAX_PIXELS")
+	cfg.Upload.MaxDimension = viper.GetInt("UPLOAD_MAX_DIMENSION")
+	cfg.Upload.StripMetadata = viper.GetBool("UPLOAD_STRIP_METADATA")
+
+	cfg.Processing.Concurrency = viper.GetInt("PROCESSING_CONCURRENCY")
+	cfg.Processing.QueueDepth = viper.GetInt("PROCESSING_QUEUE_DEPTH")
+	cfg.Processing.QueueTimeout = viper.GetString("PROCESSING_QUEUE_TIMEOUT")
+
+	cfg.Metadata.RedactGPS = viper.GetBool("METADATA_REDACT_GPS")
+
+	cfg.HTTPCache.CacheControl = viper.GetString("HTTP_CACHE_CONTROL")
+
+	cfg.Cache.Enabled = viper.GetBool("CACHE_ENABLED")
+	cfg.Cache.Path = viper.GetString("CACHE_PATH")
+	cfg.Cache.MaxBytes = viper.GetInt64("CACHE_MAX_BYTES")
+
+	cfg.Signing.Enabled = viper.GetBool("SIGNING_ENABLED")
+	cfg.Signing.Keys = viper.GetString("SIGNING_KEYS")
+	cfg.Signing.ActiveKey = viper.GetString("SIGNING_ACTIVE_KEY")
+	cfg.Signing.TTL = viper.GetString("SIGNING_URL_TTL")
+
+	cfg.Janitor.Interval = viper.GetString("JANITOR_INTERVAL")
+	cfg.Janitor.TempTTL = viper.GetString("JANITOR_TEMP_TTL")
+	cfg.Janitor.TrashRetention = viper.GetString("JANITOR_TRASH_RETENTION")
 
 	// Trusted origins env is space-separated string; convert to []string
 	trustedOrigins := viper.GetString("CORS_TRUSTED_ORIGINS")
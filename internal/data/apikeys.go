@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
+)
+
+// every key starts with this, makes leaked keys easy to grep for
+const apiKeyPrefix = "osk_"
+
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Label       string      `json:"label"`
+	Plaintext   string      `json:"key,omitempty"` // only ever set right after creation
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	RevokedAt   *time.Time  `json:"revoked_at,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// generateSecret fills in the plaintext key and the
+// fields derived from it.
+func (key *APIKey) generateSecret() error {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+
+	// 32 random bytes always encode to 52 characters without padding
+	key.Plaintext = apiKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+8]
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return nil
+}
+
+// ValidateAPIKey checks a new key, its permissions have to be a
+// subset of the ones its owner holds.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, ownerPermissions Permissions) {
+	v.Check(key.Label != "", "label", "must be provided")
+	v.Check(len(key.Label) <= 200, "label", "must not be more than 200 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(ownerPermissions.Include(code), "permissions", "must only contain permissions you have been granted")
+	}
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(plaintext) == len(apiKeyPrefix)+52, "key", "must be a valid API key")
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert generates the secret of a new key and stores it, the
+// plaintext is only available on the returned key from here on.
+func (model APIKeyModel) Insert(key *APIKey) error {
+	if err := key.generateSecret(); err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO api_keys (user_id, label, prefix, hash, permissions)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Label, key.Prefix, key.Hash, []string(key.Permissions)}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return model.DB.QueryRowContext(ctx, SQL, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (model APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	// permission codes never contain spaces, joining them keeps the
+	// scan independent of how the driver hands over arrays
+	SQL := `SELECT id, user_id, label, prefix, array_to_string(permissions, ' '), last_used_at, revoked_at, created_at
+			FROM api_keys WHERE
+			user_id=$1
+			ORDER BY created_at DESC, id DESC`
+
+	args := []interface{}{userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var permissions string
+		key := &APIKey{}
+		err = rows.Scan(&key.ID, &key.UserID, &key.Label, &key.Prefix, &permissions, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Permissions = Permissions(strings.Fields(permissions))
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Revoke disables a key of the given user for good,
+// revoking it twice is not an error.
+func (model APIKeyModel) Revoke(id, userID int64) (*APIKey, error) {
+	SQL := `UPDATE api_keys
+					SET revoked_at=COALESCE(revoked_at, NOW())
+					WHERE id=$1 AND user_id=$2
+					RETURNING id, user_id, label, prefix, array_to_string(permissions, ' '), last_used_at, revoked_at, created_at`
+
+	var permissions string
+	key := &APIKey{}
+
+	args := []interface{}{id, userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&key.ID, &key.UserID, &key.Label, &key.Prefix, &permissions, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	key.Permissions = Permissions(strings.Fields(permissions))
+
+	return key, nil
+}
+
+// GetForPlaintext returns an unrevoked key together with its owner.
+func (model APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	SQL := `SELECT k.id, k.user_id, k.label, k.prefix, array_to_string(k.permissions, ' '), k.last_used_at, k.created_at,
+			u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.version
+			FROM api_keys k
+			INNER JOIN users u ON k.user_id=u.id
+			WHERE k.hash=$1 AND k.revoked_at IS NULL`
+
+	var permissions string
+	key := &APIKey{}
+	user := &User{}
+
+	args := []interface{}{hash[:]}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(
+		&key.ID, &key.UserID, &key.Label, &key.Prefix, &permissions, &key.LastUsedAt, &key.CreatedAt,
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.Permissions = Permissions(strings.Fields(permissions))
+
+	return key, user, nil
+}
+
+// TouchLastUsed records that a key has just been used, writes are
+// throttled to once a minute so busy clients don't hammer the row.
+func (model APIKeyModel) TouchLastUsed(id int64) error {
+	SQL := `UPDATE api_keys
+					SET last_used_at=NOW()
+					WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	args := []interface{}{id}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, SQL, args...)
+	return err
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ImageMetadata is what the camera and the photographer recorded in an
+// image, extracted on upload as the file itself may be stripped of it.
+// It is stored as a JSONB column.
+type ImageMetadata struct {
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	LensMake     string     `json:"lens_make,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"` // in seconds, "1/250"
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"` // in millimeters
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	GPS          *GPS       `json:"gps,omitempty"`
+	Caption      string     `json:"caption,omitempty"`
+	Credit       string     `json:"credit,omitempty"`
+}
+
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"` // in meters
+}
+
+func (m ImageMetadata) Value() (driver.Value, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (m *ImageMetadata) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*m = ImageMetadata{}
+		return nil
+	case []byte:
+		return json.Unmarshal(src, m)
+	case string:
+		return json.Unmarshal([]byte(src), m)
+	default:
+		return fmt.Errorf("cannot scan %T into ImageMetadata", src)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -15,19 +16,29 @@ var (
 )
 
 type Image struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Alt       string    `json:"alt"`
-	FileName  string    `json:"file_name,omitempty"`
-	Size      int32     `json:"size,omitempty"`
-	Width     int32     `json:"width,omitempty"`
-	Height    int32     `json:"height,omitempty"`
-	MIMEType  string    `json:"mime_type,omitempty"`
-	URL       string    `json:"url,omitempty"` // will always be empty from DB, remember to set in handlers
-	IsTemp    bool      `json:"-"`
-	UpdatedAt time.Time `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	Version   int32     `json:"-"`
+	ID         int64         `json:"id"`
+	Name       string        `json:"name"`
+	Alt        string        `json:"alt"`
+	FileName   string        `json:"file_name,omitempty"`
+	Size       int32         `json:"size,omitempty"`
+	Width      int32         `json:"width,omitempty"`
+	Height     int32         `json:"height,omitempty"`
+	MIMEType   string        `json:"mime_type,omitempty"`
+	URL        string        `json:"url,omitempty"` // will always be empty from DB, remember to set in handlers
+	IsTemp     bool          `json:"-"`
+	UpdatedAt  time.Time     `json:"-"`
+	CreatedAt  time.Time     `json:"created_at"`
+	DeletedAt  *time.Time    `json:"deleted_at,omitempty"`
+	Version    int32         `json:"version"`
+	Metadata   ImageMetadata `json:"-"` // only served by the metadata endpoint
+	FocalPoint *FocalPoint   `json:"focal_point,omitempty"`
+}
+
+// FocalPoint is the point of interest of an image, relative to its
+// width and height, cover crops are centered on it.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
 }
 
 func ValidateImageName(v *validator.Validator, name string) {
@@ -51,6 +62,50 @@ func ValidateImage(v *validator.Validator, image *Image) {
 	v.Check(image.Height > 0, "height", "must be more than zero")
 	v.Check(image.Width > 0, "width", "must be more than zero")
 	v.Check(v.In(image.MIMEType, "image/jpeg", "image/png", "image/webp", "image/gif"), "mime_type", "must either be .jpeg, .png, .webp, or .gif")
+
+	if image.FocalPoint != nil {
+		v.Check(image.FocalPoint.X >= 0 && image.FocalPoint.X <= 1, "focal_point", "x must be between 0 and 1")
+		v.Check(image.FocalPoint.Y >= 0 && image.FocalPoint.Y <= 1, "focal_point", "y must be between 0 and 1")
+	}
+}
+
+// ImageFilters narrows down GetAll, zero values and nil pointers
+// leave the respective filter out.
+type ImageFilters struct {
+	Query         string // full-text search over alt text and name slug
+	MIMEType      string
+	IsTemp        *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	MinWidth      int
+	MaxWidth      int
+	MinHeight     int
+	MaxHeight     int
+}
+
+func ValidateImageFilters(v *validator.Validator, f ImageFilters) {
+	v.Check(len(f.Query) <= 256, "q", "must not be more than 256 bytes long")
+
+	if f.MIMEType != "" {
+		v.Check(v.In(f.MIMEType, "image/jpeg", "image/png", "image/webp", "image/gif"), "mime_type", "must either be image/jpeg, image/png, image/webp, or image/gif")
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(!f.CreatedAfter.After(*f.CreatedBefore), "created_after", "must not be after created_before")
+	}
+
+	v.Check(f.MinWidth >= 0, "min_width", "cannot be less than 0")
+	v.Check(f.MaxWidth >= 0, "max_width", "cannot be less than 0")
+	v.Check(f.MinHeight >= 0, "min_height", "cannot be less than 0")
+	v.Check(f.MaxHeight >= 0, "max_height", "cannot be less than 0")
+
+	if f.MaxWidth > 0 {
+		v.Check(f.MinWidth <= f.MaxWidth, "min_width", "must not be more than max_width")
+	}
+
+	if f.MaxHeight > 0 {
+		v.Check(f.MinHeight <= f.MaxHeight, "min_height", "must not be more than max_height")
+	}
 }
 
 type ImageModel struct {
@@ -58,11 +113,11 @@ type ImageModel struct {
 }
 
 func (model ImageModel) Insert(image *Image) error {
-	SQL := `INSERT INTO images (name, alt, file_name, size, width, height, mime_type)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
+	SQL := `INSERT INTO images (name, alt, file_name, size, width, height, mime_type, metadata)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 			RETURNING id, created_at, updated_at, version`
 
-	args := []interface{}{image.Name, image.Alt, image.FileName, image.Size, image.Width, image.Height, image.MIMEType}
+	args := []interface{}{image.Name, image.Alt, image.FileName, image.Size, image.Width, image.Height, image.MIMEType, image.Metadata}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.ID, &image.CreatedAt, &image.UpdatedAt, &image.Version)
@@ -80,16 +135,17 @@ func (model ImageModel) Insert(image *Image) error {
 
 func (model ImageModel) GetByName(name string) (*Image, error) {
 
-	SQL := `SELECT id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp
+	SQL := `SELECT id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp, metadata, focal_x, focal_y
 			FROM images WHERE
-			name=$1`
+			name=$1 AND deleted_at IS NULL`
 
 	image := &Image{}
+	var focalX, focalY sql.NullFloat64
 
 	args := []interface{}{name}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp)
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp, &image.Metadata, &focalX, &focalY)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -100,16 +156,26 @@ func (model ImageModel) GetByName(name string) (*Image, error) {
 		}
 	}
 
+	if focalX.Valid && focalY.Valid {
+		image.FocalPoint = &FocalPoint{X: focalX.Float64, Y: focalY.Float64}
+	}
+
 	return image, nil
 }
 
 func (model ImageModel) Update(image *Image) error {
 	SQL := `UPDATE images
-	 				SET alt=$1, is_temp=$2, updated_at=$3, version=version + 1
-					WHERE id=$4 AND version=$5 
+	 				SET alt=$1, is_temp=$2, updated_at=$3, focal_x=$4, focal_y=$5, version=version + 1
+					WHERE id=$6 AND version=$7 
 					RETURNING version`
 
-	args := []interface{}{image.Alt, image.IsTemp, image.UpdatedAt, image.ID, image.Version}
+	var focalX, focalY sql.NullFloat64
+	if image.FocalPoint != nil {
+		focalX = sql.NullFloat64{Float64: image.FocalPoint.X, Valid: true}
+		focalY = sql.NullFloat64{Float64: image.FocalPoint.Y, Valid: true}
+	}
+
+	args := []interface{}{image.Alt, image.IsTemp, image.UpdatedAt, focalX, focalY, image.ID, image.Version}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.Version)
@@ -124,3 +190,299 @@ func (model ImageModel) Update(image *Image) error {
 
 	return nil
 }
+
+// GetExpiredTemp returns at most limit temp images created before the
+// given time, oldest first.
+func (model ImageModel) GetExpiredTemp(before time.Time, limit int) ([]*Image, error) {
+	SQL := `SELECT id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp
+			FROM images WHERE
+			is_temp=true AND deleted_at IS NULL AND created_at < $1
+			ORDER BY created_at ASC
+			LIMIT $2`
+
+	args := []interface{}{before, limit}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []*Image{}
+	for rows.Next() {
+		image := &Image{}
+		err = rows.Scan(&image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// DeleteTemp removes a temp image row, it returns ErrEditConflict if
+// the row has been changed (e.g. committed) since it was read.
+func (model ImageModel) DeleteTemp(image *Image) error {
+	SQL := `DELETE FROM images
+			WHERE id=$1 AND version=$2 AND is_temp=true`
+
+	args := []interface{}{image.ID, image.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, SQL, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// FileNamesInUse returns which of the given file names are
+// referenced by an image row.
+func (model ImageModel) FileNamesInUse(fileNames []string) (map[string]bool, error) {
+	SQL := `SELECT file_name FROM images WHERE file_name = ANY($1)`
+
+	args := []interface{}{fileNames}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inUse := make(map[string]bool)
+	for rows.Next() {
+		var fileName string
+		err = rows.Scan(&fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		inUse[fileName] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return inUse, nil
+}
+
+func (model ImageModel) GetDeletedByName(name string) (*Image, error) {
+
+	SQL := `SELECT id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp, deleted_at
+			FROM images WHERE
+			name=$1 AND deleted_at IS NOT NULL`
+
+	image := &Image{}
+
+	args := []interface{}{name}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp, &image.DeletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+
+		default:
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+// SoftDelete moves an image to the trash, it stays restorable
+// until the janitor purges it.
+func (model ImageModel) SoftDelete(image *Image) error {
+	SQL := `UPDATE images
+					SET deleted_at=NOW(), updated_at=NOW(), version=version + 1
+					WHERE id=$1 AND version=$2 AND deleted_at IS NULL
+					RETURNING deleted_at, updated_at, version`
+
+	args := []interface{}{image.ID, image.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.DeletedAt, &image.UpdatedAt, &image.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (model ImageModel) Restore(image *Image) error {
+	SQL := `UPDATE images
+					SET deleted_at=NULL, updated_at=NOW(), version=version + 1
+					WHERE id=$1 AND version=$2 AND deleted_at IS NOT NULL
+					RETURNING updated_at, version`
+
+	args := []interface{}{image.ID, image.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := model.DB.QueryRowContext(ctx, SQL, args...).Scan(&image.UpdatedAt, &image.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	image.DeletedAt = nil
+
+	return nil
+}
+
+// GetExpiredDeleted returns at most limit trashed images deleted
+// before the given time, oldest first.
+func (model ImageModel) GetExpiredDeleted(before time.Time, limit int) ([]*Image, error) {
+	SQL := `SELECT id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp, deleted_at
+			FROM images WHERE
+			deleted_at < $1
+			ORDER BY deleted_at ASC
+			LIMIT $2`
+
+	args := []interface{}{before, limit}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []*Image{}
+	for rows.Next() {
+		image := &Image{}
+		err = rows.Scan(&image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp, &image.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// DeleteTrashed permanently removes a trashed image row, it returns
+// ErrEditConflict if the image has been restored since it was read.
+func (model ImageModel) DeleteTrashed(image *Image) error {
+	SQL := `DELETE FROM images
+			WHERE id=$1 AND version=$2 AND deleted_at IS NOT NULL`
+
+	args := []interface{}{image.ID, image.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, SQL, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (model ImageModel) GetAll(imageFilters ImageFilters, filters Filters) ([]*Image, Metadata, error) {
+	SQL := fmt.Sprintf(`SELECT count(*) OVER(), id, name, alt, file_name, size, width, height, mime_type, created_at, updated_at, version, is_temp,
+			ts_rank(search, websearch_to_tsquery('english', $11)) AS rank
+			FROM images WHERE
+			deleted_at IS NULL
+			AND (search @@ websearch_to_tsquery('english', $11) OR $11 = '')
+			AND (mime_type = $1 OR $1 = '')
+			AND (is_temp = $2 OR $2 IS NULL)
+			AND (created_at >= $3 OR $3 IS NULL)
+			AND (created_at <= $4 OR $4 IS NULL)
+			AND (width >= $5 OR $5 = 0)
+			AND (width <= $6 OR $6 = 0)
+			AND (height >= $7 OR $7 = 0)
+			AND (height <= $8 OR $8 = 0)
+			ORDER BY %s %s, id ASC
+			LIMIT $9 OFFSET $10`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		imageFilters.MIMEType,
+		imageFilters.IsTemp,
+		imageFilters.CreatedAfter,
+		imageFilters.CreatedBefore,
+		imageFilters.MinWidth,
+		imageFilters.MaxWidth,
+		imageFilters.MinHeight,
+		imageFilters.MaxHeight,
+		filters.limit(),
+		filters.offset(),
+		imageFilters.Query,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, SQL, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	images := []*Image{}
+	for rows.Next() {
+		var rank float32
+		image := &Image{}
+		err = rows.Scan(&totalRecords, &image.ID, &image.Name, &image.Alt, &image.FileName, &image.Size, &image.Width, &image.Height, &image.MIMEType, &image.CreatedAt, &image.UpdatedAt, &image.Version, &image.IsTemp, &rank)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		images = append(images, image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return images, metadata, nil
+}
@@ -13,11 +13,17 @@ var (
 type Models struct {
 	Permissions PermissionModel
 	Images      ImageModel
+	Users       UserModel
+	Tokens      TokenModel
+	APIKeys     APIKeyModel
 }
 
 func NewModels(db *sql.DB) Models {
 	return Models{
 		Permissions: PermissionModel{DB: db},
 		Images:      ImageModel{DB: db},
+		Users:       UserModel{DB: db},
+		Tokens:      TokenModel{DB: db},
+		APIKeys:     APIKeyModel{DB: db},
 	}
 }
@@ -0,0 +1,323 @@
+// Package exif reads the TIFF structure EXIF data is stored in, IFD0
+// along with the Exif and GPS sub-IFDs it points to.
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrInvalid = errors.New("exif: invalid data")
+
+// Tag types, see the TIFF 6.0 specification.
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeUndefined: 1,
+	typeSLong:     4,
+	typeSRational: 8,
+}
+
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+
+	// Exif sub-IFD
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensMake           = 0xA433
+	tagLensModel          = 0xA434
+
+	// GPS sub-IFD
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// maxEntries bounds a single IFD, real ones have a few dozen
+const maxEntries = 1000
+
+type tag struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type Data struct {
+	order binary.ByteOrder
+	ifd0  map[uint16]tag
+	exif  map[uint16]tag
+	gps   map[uint16]tag
+}
+
+// Decode parses b, which starts with a TIFF header ("II*\x00" or
+// "MM\x00*"). A broken sub-IFD is skipped rather than failing the
+// whole of it, cameras write all sorts of things.
+func Decode(b []byte) (*Data, error) {
+	if len(b) < 8 {
+		return nil, ErrInvalid
+	}
+
+	var order binary.ByteOrder
+	switch string(b[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, ErrInvalid
+	}
+
+	d := &Data{order: order}
+
+	var err error
+	d.ifd0, err = d.readIFD(b, order.Uint32(b[4:8]))
+	if err != nil {
+		return nil, err
+	}
+
+	if offset, ok := d.uint(d.ifd0, tagExifIFD); ok {
+		d.exif, _ = d.readIFD(b, uint32(offset))
+	}
+
+	if offset, ok := d.uint(d.ifd0, tagGPSIFD); ok {
+		d.gps, _ = d.readIFD(b, uint32(offset))
+	}
+
+	return d, nil
+}
+
+func (d *Data) readIFD(b []byte, offset uint32) (map[uint16]tag, error) {
+	if uint64(offset)+2 > uint64(len(b)) {
+		return nil, ErrInvalid
+	}
+
+	n := int(d.order.Uint16(b[offset:]))
+	if n > maxEntries || uint64(offset)+2+uint64(n)*12 > uint64(len(b)) {
+		return nil, ErrInvalid
+	}
+
+	tags := make(map[uint16]tag, n)
+
+	for i := 0; i < n; i++ {
+		entry := b[int(offset)+2+i*12:][:12]
+
+		t := tag{typ: d.order.Uint16(entry[2:]), count: d.order.Uint32(entry[4:])}
+
+		size, ok := typeSizes[t.typ]
+		if !ok {
+			continue
+		}
+
+		length := uint64(size) * uint64(t.count)
+
+		// values of up to four bytes are stored in the entry itself
+		if length <= 4 {
+			t.value = entry[8 : 8+length]
+		} else {
+			valueOffset := uint64(d.order.Uint32(entry[8:]))
+			if valueOffset+length > uint64(len(b)) {
+				continue
+			}
+			t.value = b[valueOffset : valueOffset+length]
+		}
+
+		tags[d.order.Uint16(entry)] = t
+	}
+
+	return tags, nil
+}
+
+// uint reads the first value of an integer tag.
+func (d *Data) uint(tags map[uint16]tag, id uint16) (uint32, bool) {
+	t, ok := tags[id]
+	if !ok || t.count == 0 {
+		return 0, false
+	}
+
+	switch t.typ {
+	case typeByte:
+		return uint32(t.value[0]), true
+	case typeShort:
+		return uint32(d.order.Uint16(t.value)), true
+	case typeLong:
+		return d.order.Uint32(t.value), true
+	}
+
+	return 0, false
+}
+
+// Orientation returns how the image has to be turned to be upright,
+// 1 to 8 as in the EXIF specification, 1 when it is not set.
+func (d *Data) Orientation() int {
+	o, ok := d.uint(d.ifd0, tagOrientation)
+	if !ok || o < 1 || o > 8 {
+		return 1
+	}
+
+	return int(o)
+}
+
+// string reads an ASCII tag, without the trailing NUL and padding.
+func (d *Data) string(tags map[uint16]tag, id uint16) string {
+	t, ok := tags[id]
+	if !ok || t.typ != typeASCII {
+		return ""
+	}
+
+	if i := strings.IndexByte(string(t.value), 0); i >= 0 {
+		return strings.TrimSpace(string(t.value[:i]))
+	}
+
+	return strings.TrimSpace(string(t.value))
+}
+
+// rationals reads the numerators and denominators of a rational tag.
+func (d *Data) rationals(tags map[uint16]tag, id uint16) ([][2]uint32, bool) {
+	t, ok := tags[id]
+	if !ok || t.typ != typeRational || t.count == 0 {
+		return nil, false
+	}
+
+	values := make([][2]uint32, t.count)
+	for i := range values {
+		values[i] = [2]uint32{d.order.Uint32(t.value[i*8:]), d.order.Uint32(t.value[i*8+4:])}
+	}
+
+	return values, true
+}
+
+func (d *Data) float(tags map[uint16]tag, id uint16) (float64, bool) {
+	values, ok := d.rationals(tags, id)
+	if !ok || values[0][1] == 0 {
+		return 0, false
+	}
+
+	return float64(values[0][0]) / float64(values[0][1]), true
+}
+
+func (d *Data) Make() string      { return d.string(d.ifd0, tagMake) }
+func (d *Data) Model() string     { return d.string(d.ifd0, tagModel) }
+func (d *Data) LensMake() string  { return d.string(d.exif, tagLensMake) }
+func (d *Data) LensModel() string { return d.string(d.exif, tagLensModel) }
+
+// ExposureTime returns the exposure time as a fraction of seconds.
+func (d *Data) ExposureTime() (uint32, uint32, bool) {
+	values, ok := d.rationals(d.exif, tagExposureTime)
+	if !ok || values[0][1] == 0 {
+		return 0, 0, false
+	}
+
+	return values[0][0], values[0][1], true
+}
+
+func (d *Data) FNumber() (float64, bool)     { return d.float(d.exif, tagFNumber) }
+func (d *Data) FocalLength() (float64, bool) { return d.float(d.exif, tagFocalLength) }
+
+func (d *Data) ISO() (int, bool) {
+	iso, ok := d.uint(d.exif, tagISO)
+	return int(iso), ok
+}
+
+// TakenAt returns when the photo was taken. EXIF only records the time
+// of the camera clock, it is taken as UTC unless an offset was stored.
+func (d *Data) TakenAt() (time.Time, bool) {
+	value := d.string(d.exif, tagDateTimeOriginal)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if offset := d.string(d.exif, tagOffsetTimeOriginal); offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// Location returns the GPS position in decimal degrees.
+func (d *Data) Location() (float64, float64, bool) {
+	latitude, ok := d.degrees(tagGPSLatitude)
+	if !ok {
+		return 0, 0, false
+	}
+
+	longitude, ok := d.degrees(tagGPSLongitude)
+	if !ok {
+		return 0, 0, false
+	}
+
+	if d.string(d.gps, tagGPSLatitudeRef) == "S" {
+		latitude = -latitude
+	}
+
+	if d.string(d.gps, tagGPSLongitudeRef) == "W" {
+		longitude = -longitude
+	}
+
+	return latitude, longitude, true
+}
+
+// Altitude returns the GPS altitude in meters, negative below sea level.
+func (d *Data) Altitude() (float64, bool) {
+	altitude, ok := d.float(d.gps, tagGPSAltitude)
+	if !ok {
+		return 0, false
+	}
+
+	if ref, ok := d.uint(d.gps, tagGPSAltitudeRef); ok && ref == 1 {
+		altitude = -altitude
+	}
+
+	return altitude, true
+}
+
+// degrees converts a degrees, minutes, seconds triple.
+func (d *Data) degrees(id uint16) (float64, bool) {
+	values, ok := d.rationals(d.gps, id)
+	if !ok || len(values) < 3 {
+		return 0, false
+	}
+
+	var degrees float64
+	for i, divisor := range []float64{1, 60, 3600} {
+		if values[i][1] == 0 {
+			return 0, false
+		}
+		degrees += float64(values[i][0]) / float64(values[i][1]) / divisor
+	}
+
+	return degrees, true
+}
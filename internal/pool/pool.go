@@ -0,0 +1,94 @@
+package pool
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSaturated = errors.New("too many requests are being processed")
+
+// Pool bounds how much work runs at once. Up to concurrency callers
+// hold a slot, up to queueDepth more wait for one, anyone beyond
+// that (or waiting longer than timeout) is turned away.
+type Pool struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+
+	active atomic.Int64
+	queued atomic.Int64
+}
+
+type Stats struct {
+	Active      int64 `json:"active"`
+	Queued      int64 `json:"queued"`
+	Concurrency int   `json:"concurrency"`
+	QueueDepth  int   `json:"queue_depth"`
+}
+
+func New(concurrency, queueDepth int, timeout time.Duration) (*Pool, error) {
+	if concurrency <= 0 || queueDepth < 0 || timeout <= 0 {
+		return nil, errors.New("pool concurrency and timeout must be positive, queue depth cannot be negative")
+	}
+
+	return &Pool{
+		slots:   make(chan struct{}, concurrency),
+		queue:   make(chan struct{}, queueDepth),
+		timeout: timeout,
+	}, nil
+}
+
+// Acquire takes a slot, every successful call must be paired with
+// a call to Release. It returns ErrSaturated when the queue is full
+// or no slot frees up in time.
+func (p *Pool) Acquire() error {
+	// fast path, a slot is free right away
+	select {
+	case p.slots <- struct{}{}:
+		p.active.Add(1)
+		return nil
+	default:
+	}
+
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		return ErrSaturated
+	}
+
+	p.queued.Add(1)
+	defer func() {
+		p.queued.Add(-1)
+		<-p.queue
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		p.active.Add(1)
+		return nil
+	case <-timer.C:
+		return ErrSaturated
+	}
+}
+
+func (p *Pool) Release() {
+	p.active.Add(-1)
+	<-p.slots
+}
+
+func (p *Pool) Timeout() time.Duration {
+	return p.timeout
+}
+
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Active:      p.active.Load(),
+		Queued:      p.queued.Load(),
+		Concurrency: cap(p.slots),
+		QueueDepth:  cap(p.queue),
+	}
+}
@@ -0,0 +1,48 @@
+package pool
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolBackpressure(t *testing.T) {
+	p, err := New(1, 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("cannot initialize pool: %v", err)
+	}
+
+	if err := p.Acquire(); err != nil {
+		t.Fatalf("expected a free slot, got %v", err)
+	}
+
+	// the single queue spot is taken by a waiter that gets
+	// the slot as soon as it is released
+	acquired := make(chan error)
+	go func() { acquired <- p.Acquire() }()
+
+	for p.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Acquire(); !errors.Is(err, ErrSaturated) {
+		t.Fatalf("expected ErrSaturated with a full queue, got %v", err)
+	}
+
+	p.Release()
+
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected queued caller to get the slot, got %v", err)
+	}
+
+	if stats := p.Stats(); stats.Active != 1 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// nobody releases, the waiter gives up after the timeout
+	if err := p.Acquire(); !errors.Is(err, ErrSaturated) {
+		t.Fatalf("expected ErrSaturated after timeout, got %v", err)
+	}
+
+	p.Release()
+}
@@ -0,0 +1,157 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters added to a signed URL
+const (
+	ParamSignature = "sig"
+	ParamExpires   = "exp"
+	ParamKeyID     = "kid"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature expired")
+	ErrUnknownKey       = errors.New("unknown signing key")
+)
+
+// Signer signs and verifies URLs with HMAC-SHA256. It can hold several
+// keys at once so a key can be rotated out without breaking URLs that
+// are already out there: new URLs are signed with the active key,
+// any known key is accepted when verifying.
+type Signer struct {
+	keys        map[string][]byte
+	activeKeyID string
+	now         func() time.Time
+}
+
+// ParseKeys parses a space-separated list of "id:base64-secret" pairs.
+func ParseKeys(spec string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+
+	for _, pair := range strings.Fields(spec) {
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid signing key %q, expected id:base64-secret", pair)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %q: %w", id, err)
+		}
+
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("signing key %q must be at least 32 bytes long", id)
+		}
+
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("duplicate signing key %q", id)
+		}
+
+		keys[id] = secret
+	}
+
+	return keys, nil
+}
+
+func New(keys map[string][]byte, activeKeyID string) (*Signer, error) {
+	if _, ok := keys[activeKeyID]; !ok {
+		return nil, fmt.Errorf("active signing key %q is not in the list of keys", activeKeyID)
+	}
+
+	return &Signer{keys: keys, activeKeyID: activeKeyID, now: time.Now}, nil
+}
+
+// Sign returns a copy of query with the key id, expiry
+// and signature for path added to it. Empty parameters are
+// left out and only the first value of a parameter is kept,
+// Verify rejects anything else.
+func (s *Signer) Sign(path string, query url.Values, ttl time.Duration) url.Values {
+	signed := url.Values{}
+	for key, values := range query {
+		if key != ParamSignature && key != ParamExpires && key != ParamKeyID && len(values) > 0 && values[0] != "" {
+			signed.Set(key, values[0])
+		}
+	}
+
+	signed.Set(ParamKeyID, s.activeKeyID)
+	signed.Set(ParamExpires, strconv.FormatInt(s.now().Add(ttl).Unix(), 10))
+	signed.Set(ParamSignature, sign(s.keys[s.activeKeyID], path, signed))
+
+	return signed
+}
+
+func (s *Signer) Verify(path string, query url.Values) error {
+	signature := query.Get(ParamSignature)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	// handlers only read the first value of a parameter, a repeated or
+	// empty one would have them read something that was never signed
+	for _, values := range query {
+		if len(values) != 1 || values[0] == "" {
+			return ErrInvalidSignature
+		}
+	}
+
+	secret, ok := s.keys[query.Get(ParamKeyID)]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	expected := sign(secret, path, query)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	// only trusted once the signature is known to be good
+	expires, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if s.now().Unix() > expires {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func sign(secret []byte, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalize(path, query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalize renders path and query in a form that doesn't depend on
+// parameter order, the signature itself is left out. Every parameter
+// has exactly one value by then, see Verify.
+func canonicalize(path string, query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if key != ParamSignature {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = url.QueryEscape(key) + "=" + url.QueryEscape(query.Get(key))
+	}
+
+	return path + "?" + strings.Join(pairs, "&")
+}
@@ -0,0 +1,99 @@
+package signing
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T) map[string][]byte {
+	spec := "old:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))) +
+		" new:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+
+	keys, err := ParseKeys(spec)
+	if err != nil {
+		t.Fatalf("cannot parse keys: %v", err)
+	}
+
+	return keys
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, err := New(testKeys(t), "new")
+	if err != nil {
+		t.Fatalf("cannot initialize signer: %v", err)
+	}
+
+	path := "/v1/images/cat-123"
+	signed := signer.Sign(path, url.Values{"w": {"800"}, "blur": {"2"}}, time.Hour)
+
+	if err := signer.Verify(path, signed); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+
+	// parameter order must not matter
+	reordered, _ := url.ParseQuery("sig=" + signed.Get("sig") + "&w=800&exp=" + signed.Get("exp") + "&kid=new&blur=2")
+	if err := signer.Verify(path, reordered); err != nil {
+		t.Fatalf("expected valid signature for reordered query, got %v", err)
+	}
+
+	tampered := url.Values{}
+	for key, values := range signed {
+		tampered[key] = values
+	}
+	tampered.Set("w", "6000")
+	if err := signer.Verify(path, tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature for tampered query, got %v", err)
+	}
+
+	if err := signer.Verify("/v1/images/dog-456", signed); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature for other path, got %v", err)
+	}
+
+	// a repeated or empty parameter must not slip in a value that was
+	// never signed, handlers read only the first one
+	for _, query := range []string{"w=&w=800", "w=800&blur=&blur=2", "w=800&blur=2&format="} {
+		smuggled, _ := url.ParseQuery(query + "&exp=" + signed.Get("exp") + "&kid=new&sig=" + signed.Get("sig"))
+		if err := signer.Verify(path, smuggled); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("expected ErrInvalidSignature for %q, got %v", query, err)
+		}
+	}
+
+	if err := signer.Verify(path, url.Values{"w": {"800"}}); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("expected ErrMissingSignature, got %v", err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	signer, _ := New(testKeys(t), "new")
+
+	signed := signer.Sign("/v1/images/cat-123", url.Values{"w": {"800"}}, time.Minute)
+
+	signer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := signer.Verify("/v1/images/cat-123", signed); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keys := testKeys(t)
+
+	before, _ := New(keys, "old")
+	signed := before.Sign("/v1/images/cat-123", url.Values{"w": {"800"}}, time.Hour)
+
+	// rotated, the old key is still known so its URLs keep working
+	after, _ := New(keys, "new")
+	if err := after.Verify("/v1/images/cat-123", signed); err != nil {
+		t.Fatalf("expected URL signed with old key to verify, got %v", err)
+	}
+
+	// retired, the old key has been dropped
+	delete(keys, "old")
+	retired, _ := New(keys, "new")
+	if err := retired.Verify("/v1/images/cat-123", signed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
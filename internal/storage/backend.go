@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// Backend is where image files physically live. Every file sits in
+// one of two areas, temp (freshly uploaded) or permanent, and is
+// addressed by its file name inside that area.
+type Backend interface {
+	Save(fileName string, isTemp bool, r io.Reader) error
+	Open(fileName string, isTemp bool) (File, error)
+	Stat(fileName string, isTemp bool) (*FileInfo, error)
+	Move(fileName string, fromTemp, toTemp bool) error
+	Delete(fileName string, isTemp bool) error
+	List(isTemp bool) ([]FileInfo, error)
+}
+
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+type FileInfo struct {
+	Name    string
+	IsTemp  bool
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type FileSystem struct {
+	path     string
+	tempPath string
+}
+
+func NewFileSystem(path, tempPath string) (*FileSystem, error) {
+
+	for _, item := range []string{path, tempPath} {
+		if err := os.MkdirAll(item, 0755); err != nil { // Set directory permissions to 0755
+			return nil, fmt.Errorf("failed to create directory %s: %w", item, err)
+		}
+	}
+
+	return &FileSystem{path, tempPath}, nil
+}
+
+func (s *FileSystem) fullPath(fileName string, isTemp bool) (string, error) {
+	basePath := s.path
+	if isTemp {
+		basePath = s.tempPath
+	}
+
+	// file names never contain directories, anything else
+	// could be used to escape the upload directories
+	if basePath == "" || fileName == "" || fileName != filepath.Base(fileName) {
+		return "", errors.New("invalid path or filename")
+	}
+
+	return filepath.Join(basePath, fileName), nil
+}
+
+func (s *FileSystem) Save(fileName string, isTemp bool, r io.Reader) error {
+	path, err := s.fullPath(fileName, isTemp)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return ErrFileCreate
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return ErrSystem
+	}
+
+	return f.Close()
+}
+
+func (s *FileSystem) Open(fileName string, isTemp bool) (File, error) {
+	path, err := s.fullPath(fileName, isTemp)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (s *FileSystem) Stat(fileName string, isTemp bool) (*FileInfo, error) {
+	path, err := s.fullPath(fileName, isTemp)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+
+	return &FileInfo{Name: fileName, IsTemp: isTemp, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *FileSystem) Move(fileName string, fromTemp, toTemp bool) error {
+	source, err := s.fullPath(fileName, fromTemp)
+	if err != nil {
+		return err
+	}
+
+	destination, err := s.fullPath(fileName, toTemp)
+	if err != nil {
+		return err
+	}
+
+	if source == destination {
+		return nil
+	}
+
+	// Rename is atomic when both directories share a filesystem,
+	// fall back to copying when they don't
+	if err := os.Rename(source, destination); err == nil {
+		return nil
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return ErrFileNotFound
+	}
+
+	return copyFile(source, destination)
+}
+
+func (s *FileSystem) Delete(fileName string, isTemp bool) error {
+	path, err := s.fullPath(fileName, isTemp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrFileNotFound
+		}
+		return ErrSystem
+	}
+
+	return nil
+}
+
+func (s *FileSystem) List(isTemp bool) ([]FileInfo, error) {
+	basePath := s.path
+	if isTemp {
+		basePath = s.tempPath
+	}
+
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			// removed between ReadDir and Info
+			continue
+		}
+
+		files = append(files, FileInfo{Name: entry.Name(), IsTemp: isTemp, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+
+	return files, nil
+}
+
+func copyFile(source, destination string) error {
+	// Open the source file
+	src, err := os.Open(source)
+	if err != nil {
+		return ErrSystem
+	}
+	defer src.Close()
+
+	// Get file information for permissions
+	fi, err := src.Stat()
+	if err != nil {
+		return ErrSystem
+	}
+
+	// Prepare the destination file
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	perm := fi.Mode() & os.ModePerm
+	dst, err := os.OpenFile(destination, flag, perm)
+	if err != nil {
+		return ErrSystem
+	}
+
+	// Copy data from source to destination
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		os.Remove(destination)
+		return ErrFileMove
+	}
+
+	// Close the destination file explicitly
+	if err := dst.Close(); err != nil {
+		return ErrSystem
+	}
+
+	// Ensure the source file is closed
+	if err := src.Close(); err != nil {
+		return ErrSystem
+	}
+
+	// Remove the source file
+	if err := os.Remove(source); err != nil {
+		return ErrSystem
+	}
+
+	return nil
+}
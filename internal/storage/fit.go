@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"image"
+	"math"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+)
+
+// Fit modes, how an image is made to fit the requested width and height.
+const (
+	FitCover   = "cover"   // fill the box, cropping what overflows
+	FitContain = "contain" // fit inside the box, keeping the aspect ratio
+	FitFill    = "fill"    // stretch to the box, ignoring the aspect ratio
+	FitInside  = "inside"  // like contain, but never enlarging
+	FitOutside = "outside" // cover the box without cropping
+	FitPad     = "pad"     // contain, then pad to the box
+)
+
+var FIT_MODES = []string{FitCover, FitContain, FitFill, FitInside, FitOutside, FitPad}
+
+// GRAVITIES maps the nine anchors of the gravity param to where they
+// sit on either axis, 0 being the left or top edge and 1 the right or
+// bottom one.
+var GRAVITIES = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"northeast": {1, 0},
+	"east":      {1, 0.5},
+	"southeast": {1, 1},
+	"south":     {0.5, 1},
+	"southwest": {0, 1},
+	"west":      {0, 0.5},
+	"northwest": {0, 0},
+}
+
+// layout describes how a source image becomes the output: it is scaled
+// to scaled, the crop rectangle of that is kept and drawn at offset on
+// an output of size canvas.
+type layout struct {
+	scaled image.Point
+	crop   image.Rectangle
+	canvas image.Point
+	offset image.Point
+}
+
+func fullLayout(width, height int) layout {
+	size := image.Pt(width, height)
+	return layout{scaled: size, crop: image.Rectangle{Max: size}, canvas: size}
+}
+
+// isIdentity is true when the layout leaves the source as it is.
+func (l layout) isIdentity(width, height int) bool {
+	return l == fullLayout(width, height)
+}
+
+// source is the part of a width x height source the crop window covers.
+// Cutting it out before scaling keeps the work down to the size of the
+// output, the source is never scaled as a whole to crop most of it away.
+func (l layout) source(width, height int) image.Rectangle {
+	sx := float64(width) / float64(l.scaled.X)
+	sy := float64(height) / float64(l.scaled.Y)
+
+	return scaleRect(l.crop, sx, sy).Intersect(image.Rect(0, 0, width, height))
+}
+
+// fit returns the effective fit mode, crop=true being short for cover.
+func (opts *ImageProcessingOption) fit() string {
+	if opts.Crop && opts.Fit == "" {
+		return FitCover
+	}
+	return opts.Fit
+}
+
+// computeLayout works out the layout of a width x height source.
+// Without a fit mode the image is only ever scaled down, as it always
+// has been, the fit modes scale up as well unless stated otherwise.
+func computeLayout(width, height int, opts *ImageProcessingOption) layout {
+	w, h := opts.Width, opts.Height
+	sx, sy := float64(w)/float64(width), float64(h)/float64(height)
+
+	switch opts.fit() {
+	case FitFill:
+		return fullLayout(w, h)
+
+	case FitContain, FitInside, FitPad:
+		scale := math.Min(sx, sy)
+		if w <= 0 {
+			scale = sy
+		} else if h <= 0 {
+			scale = sx
+		}
+		if opts.Fit == FitInside {
+			scale = math.Min(scale, 1)
+		}
+		scale = math.Min(scale, maxScale(width, height))
+
+		l := fullLayout(scaleSide(width, scale), scaleSide(height, scale))
+		if opts.Fit == FitPad {
+			gravity := GRAVITIES[opts.Gravity]
+			if opts.Gravity == "" {
+				gravity = GRAVITIES["center"]
+			}
+
+			l.canvas = image.Pt(w, h)
+			l.offset = image.Pt(
+				int(math.Round(float64(w-l.scaled.X)*gravity[0])),
+				int(math.Round(float64(h-l.scaled.Y)*gravity[1])),
+			)
+		}
+		return l
+
+	case FitOutside:
+		scale := math.Min(math.Max(sx, sy), maxScale(width, height))
+
+		return fullLayout(scaleSide(width, scale), scaleSide(height, scale))
+
+	case FitCover:
+		// crop=true predates the fit modes and never enlarged, images
+		// not larger than the box on both sides are left as they are
+		if opts.Fit == "" && (w >= width || h >= height) {
+			return fullLayout(width, height)
+		}
+
+		// scaled can be huge for thin images, it is never allocated, see
+		// layout.source
+		scale := math.Max(sx, sy)
+		scaled := image.Pt(max(w, scaleSide(width, scale)), max(h, scaleSide(height, scale)))
+
+		return layout{
+			scaled: scaled,
+			crop:   cropWindow(scaled, image.Pt(w, h), opts.Gravity, opts.FocalPoint),
+			canvas: image.Pt(w, h),
+		}
+	}
+
+	// no fit mode, scale down only and only if both sides fit
+	if w < width && h < height && (w >= 50 || h >= 50) {
+		if w <= 0 {
+			w = scaleSide(width, sy)
+		}
+		if h <= 0 {
+			h = scaleSide(height, sx)
+		}
+		return fullLayout(w, h)
+	}
+
+	return fullLayout(width, height)
+}
+
+// cropWindow places a box of size within scaled, anchored by gravity,
+// or centered on the focal point when no gravity is given.
+func cropWindow(scaled, size image.Point, gravity string, focal *data.FocalPoint) image.Rectangle {
+	excess := scaled.Sub(size)
+
+	var topLeft image.Point
+
+	if anchor, ok := GRAVITIES[gravity]; ok {
+		topLeft = image.Pt(int(math.Round(float64(excess.X)*anchor[0])), int(math.Round(float64(excess.Y)*anchor[1])))
+	} else if focal != nil {
+		topLeft = image.Pt(
+			clamp(int(math.Round(focal.X*float64(scaled.X)-float64(size.X)/2)), 0, excess.X),
+			clamp(int(math.Round(focal.Y*float64(scaled.Y)-float64(size.Y)/2)), 0, excess.Y),
+		)
+	} else {
+		topLeft = image.Pt(excess.X/2, excess.Y/2)
+	}
+
+	return image.Rectangle{Min: topLeft, Max: topLeft.Add(size)}
+}
+
+// maxScale is the largest scale a width x height source can take, one
+// huge side must not blow up the other one. Sources already larger than
+// MAX_IMAGE_DIM are never enlarged, but are not made to shrink either.
+func maxScale(width, height int) float64 {
+	return math.Max(1, float64(MAX_IMAGE_DIM)/float64(max(width, height)))
+}
+
+// scaleRect scales r, rounding outwards so that the result covers every
+// pixel r touches. The slack absorbs floating point error, which would
+// otherwise round an exact edge out by a whole pixel.
+func scaleRect(r image.Rectangle, sx, sy float64) image.Rectangle {
+	const slack = 1e-9
+	return image.Rect(
+		int(math.Floor(float64(r.Min.X)*sx+slack)),
+		int(math.Floor(float64(r.Min.Y)*sy+slack)),
+		int(math.Ceil(float64(r.Max.X)*sx-slack)),
+		int(math.Ceil(float64(r.Max.Y)*sy-slack)),
+	)
+}
+
+func scaleSide(side int, scale float64) int {
+	return max(1, int(math.Round(float64(side)*scale)))
+}
+
+func clamp(value, low, high int) int {
+	return max(low, min(value, high))
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// MAX_GIF_FRAMES caps the frames of an animated GIF, every one of them
+// is decoded and transformed on its own.
+const MAX_GIF_FRAMES = 1000
+
+// gifFrame is where a frame sits on the screen and the offset its image
+// data ends at in the file.
+type gifFrame struct {
+	bounds image.Rectangle
+	end    int
+}
+
+// scanGIF walks the blocks of a GIF to find its frames without decoding
+// any of them. It stops at anything it does not understand, broken files
+// are left for the decoder to reject.
+func scanGIF(b []byte) []gifFrame {
+	// header and logical screen descriptor
+	if len(b) < 13 {
+		return nil
+	}
+	pos := 13
+	if b[10]&0x80 != 0 {
+		pos += 3 << (b[10]&0x07 + 1)
+	}
+
+	var frames []gifFrame
+
+	for pos >= 0 && pos < len(b) {
+		switch b[pos] {
+		case 0x21: // extension: label, data sub-blocks
+			pos = skipGIFSubBlocks(b, pos+2)
+
+		case 0x2C: // image descriptor, then the LZW minimum code size
+			if pos+10 > len(b) {
+				return frames
+			}
+			x, y := int(binary.LittleEndian.Uint16(b[pos+1:])), int(binary.LittleEndian.Uint16(b[pos+3:]))
+			w, h := int(binary.LittleEndian.Uint16(b[pos+5:])), int(binary.LittleEndian.Uint16(b[pos+7:]))
+			flags := b[pos+9]
+
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+
+			pos = skipGIFSubBlocks(b, pos+1)
+			if pos < 0 {
+				return frames
+			}
+
+			frames = append(frames, gifFrame{bounds: image.Rect(x, y, x+w, y+h), end: pos})
+
+		default: // the trailer, or garbage
+			return frames
+		}
+	}
+
+	return frames
+}
+
+// skipGIFSubBlocks returns the offset past the sub-blocks at pos, -1 if
+// they run past the end of b.
+func skipGIFSubBlocks(b []byte, pos int) int {
+	for pos < len(b) {
+		size := int(b[pos])
+		pos += 1 + size
+		if size == 0 {
+			return pos
+		}
+	}
+	return -1
+}
+
+// checkGIFLimits makes sure decoding frames stays within limits, which
+// only cover the screen a single frame is drawn on. Frames decode to a
+// byte per pixel, a still image to four, so four times the pixel limit
+// across all frames takes as much memory as the largest still.
+func checkGIFLimits(frames []gifFrame, limits Limits) error {
+	if len(frames) > MAX_GIF_FRAMES {
+		return fmt.Errorf("%w: %d frames, must be at most %d", ErrImageTooLarge, len(frames), MAX_GIF_FRAMES)
+	}
+
+	var total int64
+	for _, frame := range frames {
+		total += int64(frame.bounds.Dx()) * int64(frame.bounds.Dy())
+	}
+
+	if total > 4*limits.MaxPixels {
+		return fmt.Errorf("%w: %d pixels across all frames, must be at most %d", ErrImageTooLarge, total, 4*limits.MaxPixels)
+	}
+
+	return nil
+}
+
+// decodeGIFFrame renders frame n of a GIF the way a browser shows it,
+// every frame before it drawn and disposed of in order. Frames after n
+// are never decoded.
+func decodeGIFFrame(r io.Reader, n int, limits Limits) (image.Image, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrSystem
+	}
+
+	frames := scanGIF(content)
+	if n >= len(frames) {
+		return nil, ErrFrameOutOfRange
+	}
+
+	frames = frames[:n+1]
+	if err := checkGIFLimits(frames, limits); err != nil {
+		return nil, err
+	}
+
+	// cut off after frame n, the trailer ends the file
+	truncated := append(content[:frames[n].end:frames[n].end], 0x3B)
+
+	g, err := gif.DecodeAll(bytes.NewReader(truncated))
+	if err != nil || len(g.Image) != n+1 {
+		return nil, ErrOpenImage
+	}
+
+	return composeGIFFrame(g, n), nil
+}
+
+// composeGIFFrame draws the frames of g up to frame n onto its screen.
+func composeGIFFrame(g *gif.GIF, n int) *image.NRGBA {
+	canvas := image.NewNRGBA(gifBounds(g))
+
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if i == n {
+			break
+		}
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return canvas
+}
+
+// ProcessGIF applies opts to every frame of an animated GIF. Frames are
+// scaled and cropped in place rather than flattened, so frame offsets,
+// delays and disposal methods all carry over to the result. Padding is
+// left uncovered by any frame, which shows as transparent.
+func ProcessGIF(r io.ReadSeeker, opts *ImageProcessingOption, limits Limits) (*gif.GIF, error) {
+	if _, err := checkLimits(r, limits); err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrSystem
+	}
+
+	if err := checkGIFLimits(scanGIF(content), limits); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrOpenImage
+	}
+
+	bounds := gifBounds(g)
+	l := computeLayout(bounds.Dx(), bounds.Dy(), opts)
+	if opts.Gravity == GravitySmart {
+		// the first frame has to stand for the whole animation
+		l.crop = smartCrop(composeGIFFrame(g, 0), l.scaled, l.crop.Size())
+	}
+
+	if l.isIdentity(bounds.Dx(), bounds.Dy()) && opts.BlurSigma == 0 {
+		return g, nil
+	}
+
+	scaleX := float64(l.scaled.X) / float64(bounds.Dx())
+	scaleY := float64(l.scaled.Y) / float64(bounds.Dy())
+
+	// where the crop window lands on the output, frames are clipped
+	// to it, whatever lies outside of it is padding
+	window := image.Rectangle{Min: l.offset, Max: l.offset.Add(l.crop.Size())}
+
+	out := &gif.GIF{
+		LoopCount:       g.LoopCount,
+		BackgroundIndex: g.BackgroundIndex,
+		Config:          image.Config{ColorModel: g.Config.ColorModel, Width: l.canvas.X, Height: l.canvas.Y},
+	}
+
+	// delay of frames cropped away entirely, added to a neighbour
+	pendingDelay := 0
+
+	for i, frame := range g.Image {
+		fb := frame.Bounds()
+
+		// where the frame lands on the scaled, uncropped image
+		placed := scaleRect(fb, scaleX, scaleY).Sub(l.crop.Min).Add(l.offset)
+		visible := placed.Intersect(window)
+
+		if visible.Empty() {
+			if len(out.Image) > 0 {
+				out.Delay[len(out.Delay)-1] += g.Delay[i]
+			} else {
+				pendingDelay += g.Delay[i]
+			}
+			continue
+		}
+
+		// only the visible part of the frame is scaled, see layout.source
+		src := scaleRect(visible.Sub(l.offset).Add(l.crop.Min), 1/scaleX, 1/scaleY).Intersect(fb)
+		dst := scaleRect(src, scaleX, scaleY).Sub(l.crop.Min).Add(l.offset)
+
+		var img image.Image = frame.SubImage(src)
+		if dst.Size() != src.Size() {
+			img = imaging.Resize(img, dst.Dx(), dst.Dy(), imaging.Lanczos)
+		}
+
+		if opts.BlurSigma > 0 {
+			img = imaging.Blur(img, opts.BlurSigma)
+		}
+
+		paletted := image.NewPaletted(visible, frame.Palette)
+		draw.Draw(paletted, visible, img, img.Bounds().Min.Add(visible.Min.Sub(dst.Min)), draw.Src)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i]+pendingDelay)
+		out.Disposal = append(out.Disposal, g.Disposal[i])
+		pendingDelay = 0
+	}
+
+	if len(out.Image) == 0 {
+		return nil, ErrOpenImage
+	}
+
+	return out, nil
+}
+
+// gifBounds is the logical screen of a GIF, which some encoders leave
+// unset, falling back to the union of its frames.
+func gifBounds(g *gif.GIF) image.Rectangle {
+	if g.Config.Width > 0 && g.Config.Height > 0 {
+		return image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	}
+
+	var bounds image.Rectangle
+	for _, frame := range g.Image {
+		bounds = bounds.Union(frame.Bounds())
+	}
+
+	return image.Rect(0, 0, bounds.Max.X, bounds.Max.Y)
+}
@@ -0,0 +1,515 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/exif"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/pool"
+)
+
+// REENCODE_QUALITY is used when an upload has to be re-encoded to bake
+// its orientation in, high enough that the loss is not visible.
+const REENCODE_QUALITY = 95
+
+// MAX_METADATA_TEXT caps free text taken over from a file.
+const MAX_METADATA_TEXT = 2000
+
+var (
+	exifHeader      = []byte("Exif\x00\x00")
+	iccHeader       = []byte("ICC_PROFILE\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+	pngHeader       = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// UploadPolicy controls how uploads are rewritten before being stored.
+type UploadPolicy struct {
+	// StripMetadata removes EXIF, XMP, IPTC and text metadata from
+	// originals. Images that are not upright are rotated first, so the
+	// orientation survives the EXIF data it was stored in.
+	StripMetadata bool
+
+	// Pool bounds re-encoding uploads along with image processing,
+	// nil leaves it unbounded.
+	Pool *pool.Pool
+}
+
+// readEXIF finds the EXIF block of an image, nil when there is none.
+func readEXIF(content []byte, mimeType string) *exif.Data {
+	var raw []byte
+
+	switch mimeType {
+	case "image/jpeg":
+		walkJPEG(content, func(marker byte, segment []byte) bool {
+			if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+				raw = segment[len(exifHeader):]
+				return false
+			}
+			return true
+		})
+	case "image/png":
+		walkPNG(content, func(typ string, chunk []byte) bool {
+			if typ == "eXIf" {
+				raw = chunk
+				return false
+			}
+			return true
+		})
+	case "image/webp":
+		walkWebP(content, func(fourCC string, chunk []byte) bool {
+			if fourCC == "EXIF" {
+				raw = bytes.TrimPrefix(chunk, exifHeader)
+				return false
+			}
+			return true
+		})
+	case "image/tiff":
+		raw = content
+	}
+
+	if raw == nil {
+		return nil
+	}
+
+	parsed, err := exif.Decode(raw)
+	if err != nil {
+		return nil
+	}
+
+	return parsed
+}
+
+// extractMetadata collects the EXIF and IPTC fields worth keeping.
+// Anything missing or broken is left out, it never fails an upload.
+func extractMetadata(exifData *exif.Data, iptc map[int]string) data.ImageMetadata {
+	var m data.ImageMetadata
+
+	if exifData != nil {
+		m.CameraMake = sanitize(exifData.Make())
+		m.CameraModel = sanitize(exifData.Model())
+		m.LensMake = sanitize(exifData.LensMake())
+		m.LensModel = sanitize(exifData.LensModel())
+
+		if num, den, ok := exifData.ExposureTime(); ok && num > 0 {
+			if num >= den {
+				m.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			} else {
+				m.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+			}
+		}
+
+		m.FNumber, _ = exifData.FNumber()
+		m.FocalLength, _ = exifData.FocalLength()
+		m.ISO, _ = exifData.ISO()
+
+		if takenAt, ok := exifData.TakenAt(); ok {
+			m.TakenAt = &takenAt
+		}
+
+		if latitude, longitude, ok := exifData.Location(); ok {
+			m.GPS = &data.GPS{Latitude: latitude, Longitude: longitude}
+			if altitude, ok := exifData.Altitude(); ok {
+				m.GPS.Altitude = &altitude
+			}
+		}
+	}
+
+	m.Caption = sanitize(iptc[iptcCaption])
+	m.Credit = sanitize(iptc[iptcCredit])
+
+	return m
+}
+
+// sanitize makes free text from a file safe to store, cameras pad
+// strings, IPTC predates UTF-8 and JSONB cannot hold NUL characters.
+func sanitize(s string) string {
+	if !utf8.ValidString(s) {
+		// the IPTC default is ISO 8859-1, whose code points match Unicode
+		runes := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			runes[i] = rune(s[i])
+		}
+		s = string(runes)
+	}
+
+	s = strings.TrimSpace(strings.ReplaceAll(s, "\x00", ""))
+	if len(s) > MAX_METADATA_TEXT {
+		s = strings.ToValidUTF8(s[:MAX_METADATA_TEXT], "")
+	}
+
+	return s
+}
+
+// IPTC datasets of the application record (2) that are extracted
+const (
+	iptcCredit  = 110
+	iptcCaption = 120
+)
+
+// readIPTC reads the application record datasets of the IPTC block a
+// JPEG carries in its Photoshop (APP13) segment.
+func readIPTC(content []byte, mimeType string) map[int]string {
+	if mimeType != "image/jpeg" {
+		return nil
+	}
+
+	var resources []byte
+	walkJPEG(content, func(marker byte, segment []byte) bool {
+		if marker == 0xED && bytes.HasPrefix(segment, photoshopHeader) {
+			resources = segment[len(photoshopHeader):]
+			return false
+		}
+		return true
+	})
+
+	// image resource blocks: "8BIM", id, padded pascal name, size, data
+	for len(resources) >= 12 && string(resources[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(resources[4:])
+		nameLength := int(resources[6]) + 1
+		nameLength += nameLength % 2
+
+		if 6+nameLength+4 > len(resources) {
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint32(resources[6+nameLength:]))
+		start := 6 + nameLength + 4
+		if size < 0 || start+size > len(resources) {
+			return nil
+		}
+
+		if id == 0x0404 {
+			return readIPTCRecords(resources[start : start+size])
+		}
+
+		resources = resources[min(start+size+size%2, len(resources)):]
+	}
+
+	return nil
+}
+
+func readIPTCRecords(b []byte) map[int]string {
+	values := make(map[int]string)
+
+	// datasets: 0x1C, record, dataset, size, data
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, dataset := b[1], int(b[2])
+		size := int(binary.BigEndian.Uint16(b[3:]))
+
+		// extended datasets are never used for text
+		if size&0x8000 != 0 || 5+size > len(b) {
+			break
+		}
+
+		if record == 2 {
+			if _, ok := values[dataset]; !ok {
+				values[dataset] = string(b[5 : 5+size])
+			}
+		}
+
+		b = b[5+size:]
+	}
+
+	return values
+}
+
+// stripMetadata rewrites content without metadata. JPEG, PNG and WebP
+// are stripped losslessly by dropping segments or chunks, unless the
+// image has to be rotated. TIFF keeps its metadata in the same
+// structure as the image and is always re-encoded (losslessly). GIF
+// and BMP are returned as they are.
+func stripMetadata(content []byte, mimeType string, orientation int) ([]byte, error) {
+	if needsReencode(mimeType, orientation) {
+		return reencode(content, mimeType, orientation)
+	}
+
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEG(content)
+	case "image/png":
+		return stripPNG(content)
+	case "image/webp":
+		return stripWebP(content)
+	}
+
+	return content, nil
+}
+
+// needsReencode is true when stripping metadata takes decoding the image.
+func needsReencode(mimeType string, orientation int) bool {
+	return orientation > 1 || mimeType == "image/tiff"
+}
+
+// reencode decodes content, turns it upright and encodes it again. JPEG
+// and PNG keep their ICC profile, WebP and TIFF lose it.
+func reencode(content []byte, mimeType string, orientation int) ([]byte, error) {
+	img, err := imaging.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	buf := new(bytes.Buffer)
+
+	// none of the encoders write any metadata
+	err = Encode(buf, orient(img, orientation), mimeType, &ImageProcessingOption{Quality: REENCODE_QUALITY})
+	if err != nil {
+		return nil, err
+	}
+
+	return keepICCProfile(content, buf.Bytes(), mimeType), nil
+}
+
+// keepICCProfile copies the ICC profile of original into reencoded, an
+// image of the same type straight out of its encoder. Without it colors
+// of wide gamut photos shift once they are re-encoded.
+func keepICCProfile(original, reencoded []byte, mimeType string) []byte {
+	profile := new(bytes.Buffer)
+
+	switch mimeType {
+	case "image/jpeg":
+		// large profiles span several APP2 segments
+		walkJPEG(original, func(marker byte, segment []byte) bool {
+			if marker == 0xE2 && bytes.HasPrefix(segment, iccHeader) {
+				profile.Write([]byte{0xFF, marker})
+				binary.Write(profile, binary.BigEndian, uint16(len(segment)+2))
+				profile.Write(segment)
+			}
+			return true
+		})
+
+		if profile.Len() == 0 {
+			return reencoded
+		}
+
+		// right after the start of image marker
+		return append(append(append([]byte{}, reencoded[:2]...), profile.Bytes()...), reencoded[2:]...)
+
+	case "image/png":
+		walkPNG(original, func(typ string, chunk []byte) bool {
+			if typ == "iCCP" {
+				writePNGChunk(profile, typ, chunk)
+				return false
+			}
+			return true
+		})
+
+		// it has to come before the image data, right after IHDR
+		ihdrEnd := len(pngHeader) + 12 + 13
+		if profile.Len() == 0 || len(reencoded) < ihdrEnd {
+			return reencoded
+		}
+
+		return append(append(append([]byte{}, reencoded[:ihdrEnd]...), profile.Bytes()...), reencoded[ihdrEnd:]...)
+	}
+
+	return reencoded
+}
+
+// orient turns img upright according to an EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+
+	return img
+}
+
+// walkJPEG calls fn with every marker segment up to the start of the
+// scan, fn returns false to stop. It returns the offset the segment
+// fn stopped at, or the offset of the start of scan marker.
+func walkJPEG(content []byte, fn func(marker byte, segment []byte) bool) (int, error) {
+	if len(content) < 2 || content[0] != 0xFF || content[1] != 0xD8 {
+		return 0, ErrInvalidImage
+	}
+
+	offset := 2
+
+	for offset+4 <= len(content) {
+		if content[offset] != 0xFF {
+			return 0, ErrInvalidImage
+		}
+
+		marker := content[offset+1]
+
+		switch {
+		case marker == 0xFF: // fill byte
+			offset++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // no payload
+			offset += 2
+			continue
+		case marker == 0xDA || marker == 0xD9: // start of scan, end of image
+			return offset, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(content[offset+2:]))
+		if length < 2 || offset+2+length > len(content) {
+			return 0, ErrInvalidImage
+		}
+
+		if !fn(marker, content[offset+4:offset+2+length]) {
+			return offset, nil
+		}
+
+		offset += 2 + length
+	}
+
+	return 0, ErrInvalidImage
+}
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments.
+func stripJPEG(content []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	out.Write(content[:2])
+
+	scan, err := walkJPEG(content, func(marker byte, segment []byte) bool {
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write([]byte{0xFF, marker})
+			binary.Write(out, binary.BigEndian, uint16(len(segment)+2))
+			out.Write(segment)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out.Write(content[scan:])
+
+	return out.Bytes(), nil
+}
+
+// walkPNG calls fn with the type and data of every chunk, fn returns
+// false to stop.
+func walkPNG(content []byte, fn func(typ string, chunk []byte) bool) error {
+	if !bytes.HasPrefix(content, pngHeader) {
+		return ErrInvalidImage
+	}
+
+	offset := len(pngHeader)
+
+	for offset+12 <= len(content) {
+		length := int(binary.BigEndian.Uint32(content[offset:]))
+		if length < 0 || offset+12+length > len(content) {
+			return ErrInvalidImage
+		}
+
+		if !fn(string(content[offset+4:offset+8]), content[offset+8:offset+8+length]) {
+			return nil
+		}
+
+		offset += 12 + length
+	}
+
+	return nil
+}
+
+// stripPNG drops eXIf and the text chunks, XMP lives in an iTXt chunk.
+func stripPNG(content []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	out.Write(pngHeader)
+
+	err := walkPNG(content, func(typ string, chunk []byte) bool {
+		switch typ {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			return true
+		}
+
+		writePNGChunk(out, typ, chunk)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(out *bytes.Buffer, typ string, chunk []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(chunk)))
+	out.WriteString(typ)
+	out.Write(chunk)
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), chunk...)))
+}
+
+// walkWebP calls fn with the FourCC and data of every RIFF chunk, fn
+// returns false to stop.
+func walkWebP(content []byte, fn func(fourCC string, chunk []byte) bool) error {
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != "WEBP" {
+		return ErrInvalidImage
+	}
+
+	offset := 12
+
+	for offset+8 <= len(content) {
+		length := int(binary.LittleEndian.Uint32(content[offset+4:]))
+		if length < 0 || offset+8+length > len(content) {
+			return ErrInvalidImage
+		}
+
+		if !fn(string(content[offset:offset+4]), content[offset+8:offset+8+length]) {
+			return nil
+		}
+
+		// chunks are padded to an even size
+		offset += 8 + length + length%2
+	}
+
+	return nil
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the
+// VP8X header.
+func stripWebP(content []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	out.Write(content[:12])
+
+	err := walkWebP(content, func(fourCC string, chunk []byte) bool {
+		switch fourCC {
+		case "EXIF", "XMP ":
+			return true
+		case "VP8X":
+			if len(chunk) > 0 {
+				chunk = append([]byte{chunk[0] &^ 0x0C}, chunk[1:]...)
+			}
+		}
+
+		out.WriteString(fourCC)
+		binary.Write(out, binary.LittleEndian, uint32(len(chunk)))
+		out.Write(chunk)
+		if len(chunk)%2 == 1 {
+			out.WriteByte(0)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+
+	return stripped, nil
+}
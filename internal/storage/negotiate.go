@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+)
+
+// OUTPUT_FORMATS lists everything Encode can produce, in the order
+// formats are preferred when an Accept header ranks several equally.
+var OUTPUT_FORMATS = []string{"image/webp", "image/jpeg", "image/png", "image/gif", "image/tiff", "image/bmp"}
+
+type mediaRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// specificity of a range, an exact type beats type/* beats */*
+func (m mediaRange) specificity() int {
+	switch {
+	case m.typ == "*":
+		return 0
+	case m.subtype == "*":
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (m mediaRange) matches(mimeType string) bool {
+	typ, subtype, _ := strings.Cut(mimeType, "/")
+	return (m.typ == "*" || m.typ == typ) && (m.subtype == "*" || m.subtype == subtype)
+}
+
+// parseAccept parses an Accept header into media ranges, malformed
+// ranges are skipped. An empty header accepts anything.
+func parseAccept(header string) []mediaRange {
+	if strings.TrimSpace(header) == "" {
+		return []mediaRange{{typ: "*", subtype: "*", q: 1}}
+	}
+
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+
+		m := mediaRange{typ: typ, subtype: subtype, q: 1}
+
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+			m.q = q
+		}
+
+		ranges = append(ranges, m)
+	}
+
+	return ranges
+}
+
+// quality returns the q-value and specificity of the most specific
+// range matching mimeType, a q of 0 means it is not acceptable.
+func quality(ranges []mediaRange, mimeType string) (float64, int) {
+	q, specificity := 0.0, -1
+
+	for _, m := range ranges {
+		if m.matches(mimeType) && m.specificity() > specificity {
+			q, specificity = m.q, m.specificity()
+		}
+	}
+
+	return q, specificity
+}
+
+// OutputFormat picks the MIME type an image is encoded to. An explicit
+// fm param wins as long as the client accepts it. Otherwise the best
+// ranked format of the Accept header is used, ties going to the more
+// specific range, then to the source format, then to OUTPUT_FORMATS
+// order. WebP is never picked implicitly for GIF sources as it would
+// not keep the animation. ErrNotAcceptable is returned when nothing the
+// client accepts can be produced.
+func OutputFormat(accept string, image *data.Image, opts *ImageProcessingOption) (string, error) {
+	ranges := parseAccept(accept)
+
+	if opts.Format != "" {
+		mimeType := FORMAT_MAP[opts.Format]
+		if q, _ := quality(ranges, mimeType); q > 0 {
+			return mimeType, nil
+		}
+		return "", ErrNotAcceptable
+	}
+
+	candidates := []string{image.MIMEType}
+	for _, mimeType := range OUTPUT_FORMATS {
+		if mimeType == image.MIMEType || (mimeType == "image/webp" && image.MIMEType == "image/gif") {
+			continue
+		}
+		candidates = append(candidates, mimeType)
+	}
+
+	best, bestQ, bestSpecificity := "", 0.0, -1
+
+	for _, mimeType := range candidates {
+		q, specificity := quality(ranges, mimeType)
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = mimeType, q, specificity
+		}
+	}
+
+	if best == "" {
+		return "", ErrNotAcceptable
+	}
+
+	return best, nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
+)
+
+const (
+	// MAX_PIPELINE_STEPS caps the number of operations in an ops chain
+	MAX_PIPELINE_STEPS = 10
+
+	// MAX_PIPELINE_COST caps the estimated work of an ops chain, in
+	// megapixels processed, weighed by how expensive each operation is.
+	// Resizing a 24 MP photo costs about 100, blurring it with a sigma
+	// of 10 is just too much.
+	MAX_PIPELINE_COST = 250
+)
+
+// Operation is a single step of an ops chain.
+type Operation interface {
+	Apply(img image.Image) image.Image
+
+	// Size returns the size of the output for a width x height input.
+	Size(width, height int) (int, int)
+
+	// Cost estimates the work for a width x height input, see
+	// MAX_PIPELINE_COST.
+	Cost(width, height int) float64
+
+	// String renders the step the way it is parsed, canonically.
+	String() string
+}
+
+// ParseOperations parses an ops chain like "rotate:90|resize:800x0|blur:2".
+// Errors are added to v under "ops[i]", i being the index of the step.
+func ParseOperations(v *validator.Validator, ops string) []Operation {
+	if ops == "" {
+		return nil
+	}
+
+	steps := strings.Split(ops, "|")
+	if len(steps) > MAX_PIPELINE_STEPS {
+		v.AddError("ops", fmt.Sprintf("cannot have more than %d steps", MAX_PIPELINE_STEPS))
+		return nil
+	}
+
+	var operations []Operation
+
+	for i, step := range steps {
+		key := fmt.Sprintf("ops[%d]", i)
+		name, arg, _ := strings.Cut(step, ":")
+
+		parse, ok := operationParsers[name]
+		if !ok {
+			v.AddError(key, fmt.Sprintf("unknown operation %q", name))
+			continue
+		}
+
+		op, err := parse(arg)
+		if err != nil {
+			v.AddError(key, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+
+		operations = append(operations, op)
+	}
+
+	return operations
+}
+
+// ValidatePipelineCost checks an ops chain against the image it is
+// applied to, the sizes it produces and its cost both depend on it.
+func ValidatePipelineCost(v *validator.Validator, ops []Operation, width, height int) {
+	cost := 0.0
+
+	for i, op := range ops {
+		// sources may be larger than MAX_IMAGE_DIM, steps only must not
+		// grow them any further
+		limit := max(MAX_IMAGE_DIM, width, height)
+
+		cost += op.Cost(width, height)
+		width, height = op.Size(width, height)
+
+		if width > limit || height > limit {
+			v.AddError(fmt.Sprintf("ops[%d]", i), fmt.Sprintf("would produce a %dx%d image, each side must be at most %d pixels", width, height, limit))
+			return
+		}
+	}
+
+	v.Check(cost <= MAX_PIPELINE_COST, "ops", fmt.Sprintf("are too expensive for this image, cost %.0f exceeds %d", math.Ceil(cost), MAX_PIPELINE_COST))
+}
+
+// CanonicalOperations renders an ops chain canonically.
+func CanonicalOperations(ops []Operation) string {
+	steps := make([]string, len(ops))
+	for i, op := range ops {
+		steps[i] = op.String()
+	}
+	return strings.Join(steps, "|")
+}
+
+func applyOperations(img image.Image, ops []Operation) image.Image {
+	for _, op := range ops {
+		img = op.Apply(img)
+	}
+	return img
+}
+
+var operationParsers = map[string]func(arg string) (Operation, error){
+	"rotate":     parseRotate,
+	"flip":       parseFlip,
+	"resize":     parseResize,
+	"crop":       parseCrop,
+	"blur":       parseBlur,
+	"sharpen":    parseSharpen,
+	"grayscale":  parseGrayscale,
+	"brightness": parseBrightness,
+	"contrast":   parseContrast,
+}
+
+// megapixels is the cost unit, the larger of input and output counts
+func megapixels(width, height, outWidth, outHeight int) float64 {
+	return float64(max(width*height, outWidth*outHeight)) / 1e6
+}
+
+func parseSize(arg string) (int, int, error) {
+	w, h, ok := strings.Cut(arg, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("takes WIDTHxHEIGHT, e.g. 800x0")
+	}
+
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if errW != nil || errH != nil {
+		return 0, 0, fmt.Errorf("takes WIDTHxHEIGHT, e.g. 800x0")
+	}
+
+	if width < 0 || height < 0 || width > MAX_IMAGE_DIM || height > MAX_IMAGE_DIM {
+		return 0, 0, fmt.Errorf("width and height must be between 0 and %d", MAX_IMAGE_DIM)
+	}
+
+	return width, height, nil
+}
+
+func parseFloat(arg string, low, high float64) (float64, error) {
+	value, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(value) || value < low || value > high {
+		return 0, fmt.Errorf("takes a number between %g and %g", low, high)
+	}
+	return value, nil
+}
+
+type rotateOp struct{ angle int }
+
+func parseRotate(arg string) (Operation, error) {
+	angle, err := strconv.Atoi(arg)
+	if err != nil || (angle != 90 && angle != 180 && angle != 270) {
+		return nil, fmt.Errorf("takes 90, 180 or 270 degrees (counter-clockwise)")
+	}
+	return rotateOp{angle: angle}, nil
+}
+
+func (op rotateOp) Apply(img image.Image) image.Image {
+	switch op.angle {
+	case 90:
+		return imaging.Rotate90(img)
+	case 180:
+		return imaging.Rotate180(img)
+	default:
+		return imaging.Rotate270(img)
+	}
+}
+
+func (op rotateOp) Size(width, height int) (int, int) {
+	if op.angle == 180 {
+		return width, height
+	}
+	return height, width
+}
+
+func (op rotateOp) Cost(width, height int) float64 { return megapixels(width, height, 0, 0) }
+func (op rotateOp) String() string                 { return fmt.Sprintf("rotate:%d", op.angle) }
+
+type flipOp struct{ vertical bool }
+
+func parseFlip(arg string) (Operation, error) {
+	switch arg {
+	case "h":
+		return flipOp{}, nil
+	case "v":
+		return flipOp{vertical: true}, nil
+	}
+	return nil, fmt.Errorf("takes h or v")
+}
+
+func (op flipOp) Apply(img image.Image) image.Image {
+	if op.vertical {
+		return imaging.FlipV(img)
+	}
+	return imaging.FlipH(img)
+}
+
+func (op flipOp) Size(width, height int) (int, int) { return width, height }
+func (op flipOp) Cost(width, height int) float64    { return megapixels(width, height, 0, 0) }
+
+func (op flipOp) String() string {
+	if op.vertical {
+		return "flip:v"
+	}
+	return "flip:h"
+}
+
+// resizeOp scales to width x height, a zero side keeps the aspect ratio
+type resizeOp struct{ width, height int }
+
+func parseResize(arg string) (Operation, error) {
+	width, height, err := parseSize(arg)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 && height == 0 {
+		return nil, fmt.Errorf("width and height cannot both be 0")
+	}
+	return resizeOp{width: width, height: height}, nil
+}
+
+func (op resizeOp) Apply(img image.Image) image.Image {
+	return imaging.Resize(img, op.width, op.height, imaging.Lanczos)
+}
+
+func (op resizeOp) Size(width, height int) (int, int) {
+	switch {
+	case op.width == 0:
+		return scaleSide(width, float64(op.height)/float64(height)), op.height
+	case op.height == 0:
+		return op.width, scaleSide(height, float64(op.width)/float64(width))
+	}
+	return op.width, op.height
+}
+
+func (op resizeOp) Cost(width, height int) float64 {
+	outWidth, outHeight := op.Size(width, height)
+	return 4 * megapixels(width, height, outWidth, outHeight)
+}
+
+func (op resizeOp) String() string { return fmt.Sprintf("resize:%dx%d", op.width, op.height) }
+
+// cropOp scales to cover width x height and crops the center
+type cropOp struct{ width, height int }
+
+func parseCrop(arg string) (Operation, error) {
+	width, height, err := parseSize(arg)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("width and height cannot be 0")
+	}
+	return cropOp{width: width, height: height}, nil
+}
+
+// window is the centered part of a width x height input with the aspect
+// ratio of the output. It is cut out before scaling, scaling the whole
+// input to cover the output first can take gigapixels for thin images.
+func (op cropOp) window(width, height int) (int, int) {
+	if width*op.height < height*op.width {
+		return width, clamp(int(math.Round(float64(width*op.height)/float64(op.width))), 1, height)
+	}
+	return clamp(int(math.Round(float64(height*op.width)/float64(op.height))), 1, width), height
+}
+
+func (op cropOp) Apply(img image.Image) image.Image {
+	windowWidth, windowHeight := op.window(img.Bounds().Dx(), img.Bounds().Dy())
+	img = imaging.CropCenter(img, windowWidth, windowHeight)
+	return imaging.Resize(img, op.width, op.height, imaging.Lanczos)
+}
+
+func (op cropOp) Size(width, height int) (int, int) { return op.width, op.height }
+
+// copying the window out, then scaling it
+func (op cropOp) Cost(width, height int) float64 {
+	windowWidth, windowHeight := op.window(width, height)
+	return megapixels(windowWidth, windowHeight, 0, 0) + 4*megapixels(windowWidth, windowHeight, op.width, op.height)
+}
+
+func (op cropOp) String() string { return fmt.Sprintf("crop:%dx%d", op.width, op.height) }
+
+type blurOp struct{ sigma float64 }
+
+func parseBlur(arg string) (Operation, error) {
+	sigma, err := parseFloat(arg, 0.1, 10)
+	if err != nil {
+		return nil, err
+	}
+	return blurOp{sigma: sigma}, nil
+}
+
+func (op blurOp) Apply(img image.Image) image.Image { return imaging.Blur(img, op.sigma) }
+func (op blurOp) Size(width, height int) (int, int) { return width, height }
+
+// the blur kernel grows with sigma
+func (op blurOp) Cost(width, height int) float64 {
+	return (1 + op.sigma) * megapixels(width, height, 0, 0)
+}
+
+func (op blurOp) String() string { return "blur:" + strconv.FormatFloat(op.sigma, 'g', -1, 64) }
+
+type sharpenOp struct{ sigma float64 }
+
+func parseSharpen(arg string) (Operation, error) {
+	sigma, err := parseFloat(arg, 0.1, 10)
+	if err != nil {
+		return nil, err
+	}
+	return sharpenOp{sigma: sigma}, nil
+}
+
+func (op sharpenOp) Apply(img image.Image) image.Image { return imaging.Sharpen(img, op.sigma) }
+func (op sharpenOp) Size(width, height int) (int, int) { return width, height }
+
+// sharpening is a blur plus a pass to subtract it
+func (op sharpenOp) Cost(width, height int) float64 {
+	return (2 + op.sigma) * megapixels(width, height, 0, 0)
+}
+
+func (op sharpenOp) String() string { return "sharpen:" + strconv.FormatFloat(op.sigma, 'g', -1, 64) }
+
+type grayscaleOp struct{}
+
+func parseGrayscale(arg string) (Operation, error) {
+	if arg != "" {
+		return nil, fmt.Errorf("takes no argument")
+	}
+	return grayscaleOp{}, nil
+}
+
+func (op grayscaleOp) Apply(img image.Image) image.Image { return imaging.Grayscale(img) }
+func (op grayscaleOp) Size(width, height int) (int, int) { return width, height }
+func (op grayscaleOp) Cost(width, height int) float64    { return megapixels(width, height, 0, 0) }
+func (op grayscaleOp) String() string                    { return "grayscale" }
+
+// brightnessOp changes the brightness by a percentage, -100 to 100
+type brightnessOp struct{ percentage float64 }
+
+func parseBrightness(arg string) (Operation, error) {
+	percentage, err := parseFloat(arg, -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return brightnessOp{percentage: percentage}, nil
+}
+
+func (op brightnessOp) Apply(img image.Image) image.Image {
+	return imaging.AdjustBrightness(img, op.percentage)
+}
+
+func (op brightnessOp) Size(width, height int) (int, int) { return width, height }
+func (op brightnessOp) Cost(width, height int) float64    { return megapixels(width, height, 0, 0) }
+
+func (op brightnessOp) String() string {
+	return "brightness:" + strconv.FormatFloat(op.percentage, 'g', -1, 64)
+}
+
+// contrastOp changes the contrast by a percentage, -100 to 100
+type contrastOp struct{ percentage float64 }
+
+func parseContrast(arg string) (Operation, error) {
+	percentage, err := parseFloat(arg, -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return contrastOp{percentage: percentage}, nil
+}
+
+func (op contrastOp) Apply(img image.Image) image.Image {
+	return imaging.AdjustContrast(img, op.percentage)
+}
+
+func (op contrastOp) Size(width, height int) (int, int) { return width, height }
+func (op contrastOp) Cost(width, height int) float64    { return megapixels(width, height, 0, 0) }
+
+func (op contrastOp) String() string {
+	return "contrast:" + strconv.FormatFloat(op.percentage, 'g', -1, 64)
+}
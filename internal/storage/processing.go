@@ -1,13 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"net/http"
-	"strings"
+	"io"
 
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
@@ -25,6 +26,15 @@ type ImageProcessingOption struct {
 	Crop      bool
 	BlurSigma float64
 	Quality   int
+	Format    string
+	Frame     int // -1 keeps GIFs animated
+	Fit       string
+	Gravity   string
+	Ops       []Operation // replaces everything above but Quality, Format and Frame
+
+	// FocalPoint comes from the image rather than the request, it is
+	// left out of Canonical as any change bumps the image version
+	FocalPoint *data.FocalPoint
 }
 
 func ValidateImageProcessingOption(v *validator.Validator, opts *ImageProcessingOption) {
@@ -41,15 +51,34 @@ func ValidateImageProcessingOption(v *validator.Validator, opts *ImageProcessing
 	v.Check(opts.Quality <= 100, "quality", "cannot be more than 100")
 	v.Check(opts.BlurSigma >= 0, "blur", "cannot be less than 0")
 	v.Check(opts.BlurSigma <= 10, "blur", "cannot be more than 10")
+	v.Check(opts.Format == "" || FORMAT_MAP[opts.Format] != "", "fm", "must be one of jpeg, png, webp, gif, bmp or tiff")
 	v.Check(opts.Width <= MAX_IMAGE_DIM, "width", fmt.Sprintf("cannot be more than %d pixels wide", MAX_IMAGE_DIM))
 	v.Check(opts.Height <= MAX_IMAGE_DIM, "height", fmt.Sprintf("cannot be more than %d pixels tall", MAX_IMAGE_DIM))
 
-	if opts.Crop {
-		v.Check(opts.Width >= 50, "width", "have to be atleast 50 pixels wide")
-		v.Check(opts.Height >= 50, "height", "have to be atleast 50 pixels tall")
+	if opts.Fit != "" {
+		v.Check(v.In(opts.Fit, FIT_MODES...), "fit", "must be one of cover, contain, fill, inside, outside or pad")
+		v.Check(!opts.Crop || opts.Fit == FitCover, "crop", "cannot be combined with fit, use fit=cover")
+	}
+
+	if opts.Gravity != "" {
+		_, ok := GRAVITIES[opts.Gravity]
+		v.Check(ok || opts.Gravity == GravitySmart, "gravity", "must be one of center, north, northeast, east, southeast, south, southwest, west, northwest or smart")
+		v.Check(opts.Gravity != GravitySmart || opts.fit() == FitCover, "gravity", "smart is only supported by crop=true and fit=cover")
 	}
 
-	if !opts.Crop {
+	if len(opts.Ops) > 0 {
+		noFixed := opts.Width == 0 && opts.Height == 0 && !opts.Crop && opts.Fit == "" && opts.Gravity == "" && opts.BlurSigma == 0
+		v.Check(noFixed, "ops", "cannot be combined with w, h, crop, fit, gravity or blur")
+		return
+	}
+
+	// these produce exactly the requested box, the rest
+	// work out the missing side from the aspect ratio
+	switch opts.fit() {
+	case FitCover, FitFill, FitPad:
+		v.Check(opts.Width >= 50, "width", "have to be atleast 50 pixels wide")
+		v.Check(opts.Height >= 50, "height", "have to be atleast 50 pixels tall")
+	default:
 		if opts.Width <= 0 && opts.Height <= 0 {
 			v.AddError("width", "cannot be empty")
 			v.AddError("height", "cannot be empty")
@@ -57,81 +86,122 @@ func ValidateImageProcessingOption(v *validator.Validator, opts *ImageProcessing
 	}
 }
 
-func ProcessImage(path string, opts *ImageProcessingOption) (image.Image, error) {
-	img, err := imaging.Open(path)
+// checkLimits makes sure r is within limits before it is decoded and
+// rewinds it. The stored image passed the limits on upload, but they
+// may have been lowered since then.
+func checkLimits(r io.ReadSeeker, limits Limits) (string, error) {
+	config, format, err := image.DecodeConfig(r)
 	if err != nil {
-		return nil, ErrOpenImage
+		return "", ErrOpenImage
+	}
+
+	if err := limits.Check(config.Width, config.Height); err != nil {
+		return "", err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", ErrSystem
+	}
+
+	return format, nil
+}
+
+// ProcessImage decodes r into a still image, for GIFs the frame selected
+// by opts.Frame (the first one by default), and applies opts to it.
+func ProcessImage(r io.ReadSeeker, opts *ImageProcessingOption, limits Limits) (image.Image, error) {
+	format, err := checkLimits(r, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	var img image.Image
+
+	switch {
+	case format == "gif":
+		img, err = decodeGIFFrame(r, max(opts.Frame, 0), limits)
+	case opts.Frame > 0:
+		return nil, ErrFrameOutOfRange
+	default:
+		img, err = decodeUpright(r, FORMAT_MAP[format])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Ops) > 0 {
+		return applyOperations(img, opts.Ops), nil
 	}
 
 	width := img.Bounds().Dx()
 	height := img.Bounds().Dy()
 
-	WValid := opts.Width >= 50
-	HValid := opts.Height >= 50
-	WFitBound := opts.Width < width
-	HFitBound := opts.Height < height
-
-	WHValid := WValid && HValid
-	WHFitBounds := WFitBound && HFitBound
-	WORHValid := WValid || HValid
+	l := computeLayout(width, height, opts)
+	if opts.Gravity == GravitySmart {
+		l.crop = smartCrop(img, l.scaled, l.crop.Size())
+	}
 
-	if opts.Crop {
-		if WHFitBounds && WHValid {
-			img = imaging.Fill(img, opts.Width, opts.Height, imaging.Center, imaging.Lanczos)
-		}
+	if src := l.source(width, height); src != image.Rect(0, 0, width, height) {
+		img = imaging.Crop(img, src.Add(img.Bounds().Min))
 	}
 
-	if !opts.Crop {
-		if WHFitBounds && WORHValid {
-			img = imaging.Resize(img, opts.Width, opts.Height, imaging.Lanczos)
-		}
+	if size := l.crop.Size(); size != img.Bounds().Size() {
+		img = imaging.Resize(img, size.X, size.Y, imaging.Lanczos)
 	}
 
+	// blurred before padding, the padding stays crisp
 	if opts.BlurSigma > 0 {
-		return imaging.Blur(img, opts.BlurSigma), nil
+		img = imaging.Blur(img, opts.BlurSigma)
 	}
 
-	return img, nil
+	if l.canvas != l.crop.Size() {
+		img = imaging.Paste(imaging.New(l.canvas.X, l.canvas.Y, color.White), img, l.offset)
+	}
 
+	return img, nil
 }
 
-func EncodeImage(w http.ResponseWriter, r *http.Request, img image.Image, opts *ImageProcessingOption, image *data.Image) error {
+// decodeUpright decodes r and turns it upright. Phones store photos
+// sideways along with an EXIF orientation, which JPEG, PNG, WebP and
+// TIFF can all carry.
+func decodeUpright(r io.Reader, mimeType string) (image.Image, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrSystem
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrOpenImage
+	}
 
-	accept := r.Header.Get("Accept")
-	isWEBPSupported := strings.Contains(accept, "image/webp")
+	if exifData := readEXIF(content, mimeType); exifData != nil {
+		img = orient(img, exifData.Orientation())
+	}
+
+	return img, nil
+}
 
-	SetImageHeaders(w, image.Name+EXT_MAP[image.MIMEType], image.MIMEType)
+// Canonical renders the options in a fixed form, two option sets that
+// produce the same image always render to the same string.
+func (opts *ImageProcessingOption) Canonical() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&gravity=%s&blur=%g&q=%d&frame=%d&ops=%s", opts.Width, opts.Height, opts.fit(), opts.Gravity, opts.BlurSigma, opts.Quality, opts.Frame, CanonicalOperations(opts.Ops))
+}
 
-	switch image.MIMEType {
+func Encode(w io.Writer, img image.Image, mimeType string, opts *ImageProcessingOption) error {
+	switch mimeType {
 	case "image/jpeg":
-		if isWEBPSupported {
-			SetImageHeaders(w, image.Name+EXT_MAP["image/webp"], "image/webp")
-			return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
-		}
 		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
 
 	case "image/png":
-		if isWEBPSupported {
-			SetImageHeaders(w, image.Name+EXT_MAP["image/webp"], "image/webp")
-			return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
-		}
 		return png.Encode(w, img)
 
 	case "image/gif":
 		return gif.Encode(w, img, nil)
 
 	case "image/tiff":
-		if isWEBPSupported {
-			SetImageHeaders(w, image.Name+EXT_MAP["image/webp"], "image/webp")
-			return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
-		}
 		return tiff.Encode(w, img, nil)
 
 	case "image/bmp":
-		if isWEBPSupported {
-			SetImageHeaders(w, image.Name+EXT_MAP["image/webp"], "image/webp")
-			return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
-		}
 		return bmp.Encode(w, img)
 
 	case "image/webp":
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Options struct {
+	Endpoint        string // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Prefix          string // key prefix for permanent files
+	TempPrefix      string // key prefix for temp files
+}
+
+// S3 stores files in an S3-compatible bucket using path-style
+// requests signed with AWS Signature Version 4.
+type S3 struct {
+	client     *http.Client
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	prefix     string
+	tempPrefix string
+	now        func() time.Time
+}
+
+func NewS3(opts S3Options) (*S3, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", opts.Endpoint)
+	}
+
+	if opts.Bucket == "" {
+		return nil, errors.New("s3 bucket must be provided")
+	}
+
+	if opts.Prefix == opts.TempPrefix {
+		return nil, errors.New("s3 prefix and temp prefix must be different")
+	}
+
+	return &S3{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		endpoint:   endpoint,
+		region:     opts.Region,
+		bucket:     opts.Bucket,
+		accessKey:  opts.AccessKeyID,
+		secretKey:  opts.SecretAccessKey,
+		prefix:     opts.Prefix,
+		tempPrefix: opts.TempPrefix,
+		now:        time.Now,
+	}, nil
+}
+
+func (s *S3) key(fileName string, isTemp bool) (string, error) {
+	if fileName == "" || strings.Contains(fileName, "/") {
+		return "", errors.New("invalid path or filename")
+	}
+
+	if isTemp {
+		return s.tempPrefix + fileName, nil
+	}
+
+	return s.prefix + fileName, nil
+}
+
+func (s *S3) Save(fileName string, isTemp bool, r io.Reader) error {
+	key, err := s.key(fileName, isTemp)
+	if err != nil {
+		return err
+	}
+
+	// uploads are capped at 10MB, buffering keeps the
+	// payload hash and content length simple
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return ErrFileRead
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp)
+	}
+
+	return nil
+}
+
+func (s *S3) Open(fileName string, isTemp bool) (File, error) {
+	key, err := s.key(fileName, isTemp)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ErrFileRead
+	}
+
+	return nopCloser{bytes.NewReader(body)}, nil
+}
+
+func (s *S3) Stat(fileName string, isTemp bool) (*FileInfo, error) {
+	key, err := s.key(fileName, isTemp)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError(resp)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return &FileInfo{Name: fileName, IsTemp: isTemp, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Move(fileName string, fromTemp, toTemp bool) error {
+	source, err := s.key(fileName, fromTemp)
+	if err != nil {
+		return err
+	}
+
+	destination, err := s.key(fileName, toTemp)
+	if err != nil {
+		return err
+	}
+
+	if source == destination {
+		return nil
+	}
+
+	// S3 has no rename, copy server side then delete the source
+	headers := http.Header{}
+	headers.Set("x-amz-copy-source", "/"+s.bucket+"/"+uriEncode(source, false))
+
+	resp, err := s.do(http.MethodPut, destination, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(resp)
+	}
+
+	// a copy can fail after the 200 status line has been sent,
+	// in which case the error is reported in the body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ErrFileMove
+	}
+
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("%w: %s", ErrFileMove, body)
+	}
+
+	return s.Delete(fileName, fromTemp)
+}
+
+func (s *S3) Delete(fileName string, isTemp bool) error {
+	key, err := s.key(fileName, isTemp)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError(resp)
+	}
+
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3) List(isTemp bool) ([]FileInfo, error) {
+	prefix := s.prefix
+	if isTemp {
+		prefix = s.tempPrefix
+	}
+
+	files := []FileInfo{}
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/") // only direct children, prefixes may nest
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = s.responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			files = append(files, FileInfo{
+				Name:    strings.TrimPrefix(object.Key, prefix),
+				IsTemp:  isTemp,
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	return files, nil
+}
+
+func (s *S3) do(method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	path := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+
+	u := *s.endpoint
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSystem, err)
+	}
+
+	return resp, nil
+}
+
+func (s *S3) responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrFileNotFound
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%w: s3 responded with %s: %s", ErrSystem, resp.Status, body)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+
+	canonical, signedHeaders := canonicalRequest(req)
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalRequest builds the SigV4 canonical request of req,
+// signing the host and range headers and every x-amz-* header.
+func canonicalRequest(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	return canonical, signedHeaders
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters,
+// slashes are kept as-is unless encodeSlash is set.
+func uriEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// GravitySmart picks the crop window by its content rather than a fixed
+// anchor, see smartCrop.
+const GravitySmart = "smart"
+
+const (
+	// SMART_CROP_SIZE is the longest side of the copy that is scored,
+	// more detail than this does not change where a crop ends up
+	SMART_CROP_SIZE = 256
+
+	smartCropBlock = 8 // side of the blocks entropy is measured over
+
+	smartCropEdgeWeight       = 1.0
+	smartCropEntropyWeight    = 0.6
+	smartCropSaturationWeight = 0.4
+)
+
+// smartCrop finds the window of size within the source scaled to scaled
+// that holds the most interesting content. A downscaled copy is scored
+// pixel by pixel for edges, local entropy and saturation, and every
+// window position is tried. Equal scores go to the window closest to
+// the center, so the result only depends on the image and the sizes.
+func smartCrop(img image.Image, scaled, size image.Point) image.Rectangle {
+	excess := scaled.Sub(size)
+	if excess.X <= 0 && excess.Y <= 0 {
+		return image.Rectangle{Max: size}
+	}
+
+	ratio := math.Min(1, float64(SMART_CROP_SIZE)/float64(max(scaled.X, scaled.Y)))
+	aw, ah := scaleSide(scaled.X, ratio), scaleSide(scaled.Y, ratio)
+
+	// box filtering is plenty for scoring and much cheaper than Lanczos
+	small := imaging.Resize(img, aw, ah, imaging.Box)
+
+	sums := summedArea(scoreMap(small), aw, ah)
+
+	// the window and the positions it can take on the small copy
+	ww := min(aw, max(1, int(math.Round(float64(size.X)*float64(aw)/float64(scaled.X)))))
+	wh := min(ah, max(1, int(math.Round(float64(size.Y)*float64(ah)/float64(scaled.Y)))))
+	centerX, centerY := float64(aw-ww)/2, float64(ah-wh)/2
+
+	bestX, bestY := 0, 0
+	bestScore, bestDistance := math.Inf(-1), math.Inf(1)
+
+	for y := 0; y <= ah-wh; y++ {
+		for x := 0; x <= aw-ww; x++ {
+			score := sums[(y+wh)*(aw+1)+x+ww] - sums[y*(aw+1)+x+ww] - sums[(y+wh)*(aw+1)+x] + sums[y*(aw+1)+x]
+			distance := math.Hypot(float64(x)-centerX, float64(y)-centerY)
+
+			if score > bestScore+1e-9 || (math.Abs(score-bestScore) <= 1e-9 && distance < bestDistance) {
+				bestX, bestY, bestScore, bestDistance = x, y, score, distance
+			}
+		}
+	}
+
+	topLeft := image.Pt(
+		clamp(int(math.Round(float64(bestX)/ratio)), 0, excess.X),
+		clamp(int(math.Round(float64(bestY)/ratio)), 0, excess.Y),
+	)
+
+	return image.Rectangle{Min: topLeft, Max: topLeft.Add(size)}
+}
+
+// scoreMap rates every pixel of img, each measure normalized to 0..1
+// before they are weighed against each other.
+func scoreMap(img *image.NRGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	luma := make([]float64, w*h)
+	saturation := make([]float64, w*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			r, g, b, a := float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])/255
+
+			luma[y*w+x] = (0.299*r + 0.587*g + 0.114*b) * a
+
+			hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+			if hi > 0 {
+				saturation[y*w+x] = (hi - lo) / hi * a
+			}
+		}
+	}
+
+	edges := make([]float64, w*h)
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			// Sobel
+			at := func(dx, dy int) float64 { return luma[(y+dy)*w+x+dx] }
+			gx := at(1, -1) + 2*at(1, 0) + at(1, 1) - at(-1, -1) - 2*at(-1, 0) - at(-1, 1)
+			gy := at(-1, 1) + 2*at(0, 1) + at(1, 1) - at(-1, -1) - 2*at(0, -1) - at(1, -1)
+			edges[y*w+x] = math.Hypot(gx, gy)
+		}
+	}
+
+	entropy := make([]float64, w*h)
+	for by := 0; by < h; by += smartCropBlock {
+		for bx := 0; bx < w; bx += smartCropBlock {
+			var histogram [16]int
+			n := 0
+			for y := by; y < min(by+smartCropBlock, h); y++ {
+				for x := bx; x < min(bx+smartCropBlock, w); x++ {
+					histogram[min(15, int(luma[y*w+x])/16)]++
+					n++
+				}
+			}
+
+			e := 0.0
+			for _, count := range histogram {
+				if count > 0 {
+					p := float64(count) / float64(n)
+					e -= p * math.Log2(p)
+				}
+			}
+
+			for y := by; y < min(by+smartCropBlock, h); y++ {
+				for x := bx; x < min(bx+smartCropBlock, w); x++ {
+					entropy[y*w+x] = e
+				}
+			}
+		}
+	}
+
+	normalize(edges)
+	normalize(entropy)
+	normalize(saturation)
+
+	scores := make([]float64, w*h)
+	for i := range scores {
+		scores[i] = smartCropEdgeWeight*edges[i] + smartCropEntropyWeight*entropy[i] + smartCropSaturationWeight*saturation[i]
+	}
+
+	return scores
+}
+
+func normalize(values []float64) {
+	highest := 0.0
+	for _, v := range values {
+		highest = math.Max(highest, v)
+	}
+
+	if highest == 0 {
+		return
+	}
+
+	for i := range values {
+		values[i] /= highest
+	}
+}
+
+// summedArea returns the summed-area table of a w x h map, with an
+// extra leading row and column of zeros, so any window sums up in O(1).
+func summedArea(values []float64, w, h int) []float64 {
+	sums := make([]float64, (w+1)*(h+1))
+
+	for y := 0; y < h; y++ {
+		row := 0.0
+		for x := 0; x < w; x++ {
+			row += values[y*w+x]
+			sums[(y+1)*(w+1)+x+1] = sums[y*(w+1)+x+1] + row
+		}
+	}
+
+	return sums
+}
@@ -1,12 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
-	"os"
-	"path/filepath"
 
 	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/utils"
@@ -14,38 +13,20 @@ import (
 )
 
 type ImageStorage struct {
-	path     string
-	tempPath string
+	backend Backend
+	limits  Limits
+	policy  UploadPolicy
 }
 
-func New(path, tempPath string) (*ImageStorage, error) {
-
-	for _, item := range []string{path, tempPath} {
-		if err := os.MkdirAll(item, 0755); err != nil { // Set directory permissions to 0755
-			return nil, fmt.Errorf("failed to create directory %s: %w", item, err)
-		}
-	}
-
-	return &ImageStorage{path, tempPath}, nil
+func New(backend Backend, limits Limits, policy UploadPolicy) *ImageStorage {
+	return &ImageStorage{backend: backend, limits: limits, policy: policy}
 }
 
-func (s *ImageStorage) GetFullPath(image *data.Image) (string, error) {
-	var basePath string
-
-	if image.IsTemp {
-		basePath = s.tempPath
-	} else {
-		basePath = s.path
-	}
-
-	if basePath == "" || image.FileName == "" {
-		return "", errors.New("invalid path or filename")
-	}
-
-	return filepath.Join(basePath, image.FileName), nil
+func (s *ImageStorage) Limits() Limits {
+	return s.limits
 }
 
-func (s *ImageStorage) Save(file multipart.File, fileHeader multipart.FileHeader, isTemp bool, path string, v *validator.Validator) (*data.Image, error) {
+func (s *ImageStorage) Save(file multipart.File, fileHeader multipart.FileHeader, isTemp bool, v *validator.Validator) (*data.Image, error) {
 	// Step 1: Determine MIME type and validate support
 	mimeType, err := detectMimeType(file)
 	if err != nil {
@@ -58,6 +39,10 @@ func (s *ImageStorage) Save(file multipart.File, fileHeader multipart.FileHeader
 		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
 	}
 
+	if err := s.limits.Check(width, height); err != nil {
+		return nil, err
+	}
+
 	// Step 3: Generate file name and extension
 	name := utils.GenerateImageName(fileHeader.Filename)
 	extension := EXT_MAP[mimeType]
@@ -83,58 +68,116 @@ func (s *ImageStorage) Save(file multipart.File, fileHeader multipart.FileHeader
 		return nil, err
 	}
 
-	// Step 6: Save the file to disk
-	if err := saveFileToDisk(file, filepath.Join(path, filename)); err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrFileCreate, err)
+	// Step 6: Apply the upload policy
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, ErrSystem
 	}
 
-	return image, nil
-}
-
-func (s *ImageStorage) Move(source, destination string) error {
-	// Open the source file
-	src, err := os.Open(source)
+	content, err := io.ReadAll(file)
 	if err != nil {
-		return ErrSystem
+		return nil, ErrFileRead
 	}
-	defer src.Close()
 
-	// Get file information for permissions
-	fi, err := src.Stat()
-	if err != nil {
-		return ErrSystem
+	// read before the policy may strip it from the file
+	exifData := readEXIF(content, mimeType)
+	image.Metadata = extractMetadata(exifData, readIPTC(content, mimeType))
+
+	orientation := 1
+	if exifData != nil {
+		orientation = exifData.Orientation()
 	}
 
-	// Prepare the destination file
-	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	perm := fi.Mode() & os.ModePerm
-	dst, err := os.OpenFile(destination, flag, perm)
-	if err != nil {
-		return ErrSystem
+	if s.policy.StripMetadata {
+		// re-encoding decodes the whole image, as costly as processing it
+		if s.policy.Pool != nil && needsReencode(mimeType, orientation) {
+			if err := s.policy.Pool.Acquire(); err != nil {
+				return nil, err
+			}
+			defer s.policy.Pool.Release()
+		}
+
+		content, err = stripMetadata(content, mimeType, orientation)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+
+		// rotating may have swapped the sides
+		width, height, err = decodeImageMetadata(bytes.NewReader(content), mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+		}
+	} else if orientation >= 5 {
+		// processing honors the orientation, the stored
+		// dimensions are the ones the image is displayed with
+		width, height = height, width
 	}
 
-	// Copy data from source to destination
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		dst.Close()
-		os.Remove(destination)
-		return ErrFileMove
+	image.Size = int32(len(content))
+	image.Width = int32(width)
+	image.Height = int32(height)
+
+	// Step 7: Hand the file over to the backend
+	if err := s.backend.Save(filename, isTemp, bytes.NewReader(content)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileCreate, err)
 	}
 
-	// Close the destination file explicitly
-	if err := dst.Close(); err != nil {
-		return ErrSystem
+	return image, nil
+}
+
+// Open returns the stored file of an image. If the file is not in
+// the area the record points to, the other area is tried as well.
+func (s *ImageStorage) Open(image *data.Image) (File, error) {
+	file, err := s.backend.Open(image.FileName, image.IsTemp)
+	if errors.Is(err, ErrFileNotFound) {
+		return s.backend.Open(image.FileName, !image.IsTemp)
 	}
 
-	// Ensure the source file is closed
-	if err := src.Close(); err != nil {
-		return ErrSystem
+	return file, err
+}
+
+// Commit moves the file of a temp image into the permanent area. It
+// can be retried after a crash halfway through, a file that has
+// already been moved is left where it is.
+func (s *ImageStorage) Commit(image *data.Image) error {
+	err := s.backend.Move(image.FileName, true, false)
+	if errors.Is(err, ErrFileNotFound) {
+		if _, statErr := s.backend.Stat(image.FileName, false); statErr == nil {
+			return nil
+		}
 	}
 
-	// Remove the source file
-	if err := os.Remove(source); err != nil {
-		return ErrSystem
+	return err
+}
+
+func (s *ImageStorage) Stat(image *data.Image) (*FileInfo, error) {
+	return s.backend.Stat(image.FileName, image.IsTemp)
+}
+
+func (s *ImageStorage) Move(image *data.Image, toTemp bool) error {
+	return s.backend.Move(image.FileName, image.IsTemp, toTemp)
+}
+
+func (s *ImageStorage) Delete(image *data.Image) error {
+	return s.backend.Delete(image.FileName, image.IsTemp)
+}
+
+// Purge removes the file of an image from both areas, a commit that
+// crashed halfway may have left it in either one.
+func (s *ImageStorage) Purge(image *data.Image) error {
+	for _, isTemp := range []bool{true, false} {
+		err := s.backend.Delete(image.FileName, isTemp)
+		if err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
 	}
 
 	return nil
 }
+
+func (s *ImageStorage) DeleteFile(fileName string, isTemp bool) error {
+	return s.backend.Delete(fileName, isTemp)
+}
+
+func (s *ImageStorage) List(isTemp bool) ([]FileInfo, error) {
+	return s.backend.List(isTemp)
+}
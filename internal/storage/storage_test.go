@@ -1,8 +1,22 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
 	"os"
 	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/exif"
+	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
 )
 
 func TestMoveFile(t *testing.T) {
@@ -20,13 +34,13 @@ func TestMoveFile(t *testing.T) {
 	}
 	file.Close()
 
-	str, err := New("./upload", "./temp")
+	str, err := NewFileSystem("./upload", "./temp")
 	if err != nil {
 		t.Fatalf("cannot initialize storage: %v", err)
 	}
 
 	// Move the file
-	err = str.Move("./temp/test.txt", "./upload/test.txt")
+	err = str.Move("test.txt", true, false)
 	if err != nil {
 		t.Fatalf("cannot move test file: %v", err)
 	}
@@ -35,4 +49,504 @@ func TestMoveFile(t *testing.T) {
 	if _, err := os.Stat("./upload/test.txt"); os.IsNotExist(err) {
 		t.Fatalf("file not found in destination: %v", err)
 	}
+
+	// Check that the file is gone from the old location
+	if _, err := os.Stat("./temp/test.txt"); !os.IsNotExist(err) {
+		t.Fatalf("file still exists in source: %v", err)
+	}
+}
+
+func TestProcessImageRejectsTooManyPixels(t *testing.T) {
+	// a blank 2000x2000 PNG compresses to a few KB but
+	// decodes to 16MB, exactly what the limits are for
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 2000, 2000))); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+
+	limits := Limits{MaxPixels: 1_000_000, MaxDimension: 5000}
+	opts := &ImageProcessingOption{Width: 100, Quality: 100}
+
+	_, err := ProcessImage(bytes.NewReader(buf.Bytes()), opts, limits)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("expected ErrImageTooLarge, got %v", err)
+	}
+
+	limits.MaxPixels = 4_000_000
+	if _, err := ProcessImage(bytes.NewReader(buf.Bytes()), opts, limits); err != nil {
+		t.Fatalf("expected image within limits to be processed, got %v", err)
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	jpeg := &data.Image{MIMEType: "image/jpeg"}
+	gif := &data.Image{MIMEType: "image/gif"}
+
+	tests := []struct {
+		name    string
+		accept  string
+		image   *data.Image
+		format  string
+		want    string
+		wantErr error
+	}{
+		{"no accept header", "", jpeg, "", "image/jpeg", nil},
+		{"wildcard keeps source", "*/*", jpeg, "", "image/jpeg", nil},
+		{"browser prefers webp", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", jpeg, "", "image/webp", nil},
+		{"q-values rank formats", "image/webp;q=0.5,image/png", jpeg, "", "image/png", nil},
+		{"excluded source", "image/jpeg;q=0,image/*", jpeg, "", "image/webp", nil},
+		{"gif never implicitly webp", "image/webp,image/*", gif, "", "image/gif", nil},
+		{"nothing acceptable", "text/html", jpeg, "", "", ErrNotAcceptable},
+		{"explicit format", "*/*", jpeg, "png", "image/png", nil},
+		{"explicit format not accepted", "image/webp", jpeg, "png", "", ErrNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		got, err := OutputFormat(tt.accept, tt.image, &ImageProcessingOption{Format: tt.format})
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestProcessGIFKeepsAnimation(t *testing.T) {
+	palette := color.Palette{color.Transparent, color.Black, color.White}
+
+	// a 200x100 background and a 100x50 patch drawn over its right half
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 200, 100), palette),
+			image.NewPaletted(image.Rect(100, 50, 200, 100), palette),
+		},
+		Delay:    []int{10, 20},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground},
+		Config:   image.Config{ColorModel: palette, Width: 200, Height: 100},
+	}
+	for i := range anim.Image[1].Pix {
+		anim.Image[1].Pix[i] = 2
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+
+	limits := Limits{MaxPixels: 1_000_000, MaxDimension: 5000}
+
+	got, err := ProcessGIF(bytes.NewReader(buf.Bytes()), &ImageProcessingOption{Width: 100, Frame: -1}, limits)
+	if err != nil {
+		t.Fatalf("cannot process gif: %v", err)
+	}
+
+	if got.Config.Width != 100 || got.Config.Height != 50 {
+		t.Fatalf("expected a 100x50 canvas, got %dx%d", got.Config.Width, got.Config.Height)
+	}
+	if len(got.Image) != 2 || got.Delay[1] != 20 || got.Disposal[1] != gif.DisposalBackground {
+		t.Fatalf("expected frames, delays and disposal to be kept, got %d frames, delays %v, disposal %v", len(got.Image), got.Delay, got.Disposal)
+	}
+	if bounds := got.Image[1].Bounds(); bounds != image.Rect(50, 25, 100, 50) {
+		t.Fatalf("expected second frame at (50,25)-(100,50), got %v", bounds)
+	}
+
+	still, err := ProcessImage(bytes.NewReader(buf.Bytes()), &ImageProcessingOption{Frame: 1}, limits)
+	if err != nil {
+		t.Fatalf("cannot extract frame: %v", err)
+	}
+	if c := color.NRGBAModel.Convert(still.At(150, 75)).(color.NRGBA); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Fatalf("expected frame 1 to be composited over frame 0, got %v at (150,75)", c)
+	}
+
+	_, err = ProcessImage(bytes.NewReader(buf.Bytes()), &ImageProcessingOption{Frame: 2}, limits)
+	if !errors.Is(err, ErrFrameOutOfRange) {
+		t.Fatalf("expected ErrFrameOutOfRange, got %v", err)
+	}
+}
+
+func TestGIFFrameLimits(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+
+	// a small screen with many full screen frames
+	anim := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 100, Height: 100}}
+	for i := 0; i < 50; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 100, 100), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+
+	if frames := scanGIF(buf.Bytes()); len(frames) != 50 {
+		t.Fatalf("expected 50 frames, got %d", len(frames))
+	}
+
+	// every frame fits, all 50 of them do not
+	limits := Limits{MaxPixels: 100_000, MaxDimension: 5000}
+
+	_, err := ProcessGIF(bytes.NewReader(buf.Bytes()), &ImageProcessingOption{Width: 50, Frame: -1}, limits)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("expected ErrImageTooLarge, got %v", err)
+	}
+
+	// a single frame only decodes the frames up to it, anything after
+	// it is never read, broken or not
+	content := buf.Bytes()
+	frames := scanGIF(content)
+	broken := append(append([]byte{}, content[:frames[1].end]...), 0x2C, 0xFF, 0xFF)
+
+	if _, err := ProcessImage(bytes.NewReader(broken), &ImageProcessingOption{Width: 50, Frame: 1}, limits); err != nil {
+		t.Fatalf("cannot extract frame 1: %v", err)
+	}
+}
+
+// exifJPEG inserts an APP1 segment with the given EXIF orientation and
+// an XMP packet right after the start of image marker.
+func exifJPEG(plain []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint16(tiff[18:], orientation)
+
+	var out []byte
+	out = append(out, plain[:2]...)
+	for _, payload := range [][]byte{append([]byte("Exif\x00\x00"), tiff...), []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")} {
+		out = append(out, 0xFF, 0xE1, byte((len(payload)+2)>>8), byte(len(payload)+2))
+		out = append(out, payload...)
+	}
+
+	return append(out, plain[2:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 100, 50)), nil); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+	plain := buf.Bytes()
+
+	// upright images lose the metadata segments and nothing else
+	upright := exifJPEG(plain, 1)
+	if got := readEXIF(upright, "image/jpeg").Orientation(); got != 1 {
+		t.Fatalf("expected orientation 1, got %d", got)
+	}
+
+	stripped, err := stripMetadata(upright, "image/jpeg", 1)
+	if err != nil {
+		t.Fatalf("cannot strip metadata: %v", err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Fatalf("expected stripping to be lossless, got %d bytes from %d", len(stripped), len(plain))
+	}
+
+	// rotated ones are turned upright before the orientation is dropped
+	rotated := exifJPEG(plain, 6)
+	if got := readEXIF(rotated, "image/jpeg").Orientation(); got != 6 {
+		t.Fatalf("expected orientation 6, got %d", got)
+	}
+
+	stripped, err = stripMetadata(rotated, "image/jpeg", 6)
+	if err != nil {
+		t.Fatalf("cannot strip metadata: %v", err)
+	}
+	if readEXIF(stripped, "image/jpeg") != nil || bytes.Contains(stripped, []byte("xmpmeta")) {
+		t.Fatal("expected metadata to be gone after re-encoding")
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("cannot decode stripped image: %v", err)
+	}
+	if config.Width != 50 || config.Height != 100 {
+		t.Fatalf("expected a 50x100 upright image, got %dx%d", config.Width, config.Height)
+	}
+
+	// the color profile survives re-encoding
+	icc := append([]byte("ICC_PROFILE\x00\x01\x01"), bytes.Repeat([]byte{7}, 32)...)
+	withICC := append(append([]byte{}, rotated[:2]...), 0xFF, 0xE2, 0, byte(len(icc)+2))
+	withICC = append(append(withICC, icc...), rotated[2:]...)
+
+	stripped, err = stripMetadata(withICC, "image/jpeg", 6)
+	if err != nil {
+		t.Fatalf("cannot strip metadata: %v", err)
+	}
+	if !bytes.Contains(stripped, icc) {
+		t.Fatal("expected the ICC profile to be kept")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("cannot decode image with the profile put back: %v", err)
+	}
+}
+
+func TestProcessImageHonorsOrientation(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 100, 50))); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+	plain := buf.Bytes()
+
+	// the orientation is not only a JPEG thing, PNGs carry it in eXIf
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00")
+	rotated := bytes.NewBuffer(append([]byte{}, plain[:len(pngHeader)+25]...))
+	writePNGChunk(rotated, "eXIf", tiff)
+	rotated.Write(plain[len(pngHeader)+25:])
+
+	opts := &ImageProcessingOption{Quality: 100, Frame: -1}
+	img, err := ProcessImage(bytes.NewReader(rotated.Bytes()), opts, Limits{MaxPixels: 1_000_000, MaxDimension: 5000})
+	if err != nil {
+		t.Fatalf("cannot process image: %v", err)
+	}
+
+	if size := img.Bounds().Size(); size.X != 50 || size.Y != 100 {
+		t.Fatalf("expected a 50x100 upright image, got %dx%d", size.X, size.Y)
+	}
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// buildTIFF lays out a little-endian IFD0 and a GPS IFD, values that do
+// not fit into an entry follow their IFD.
+func buildTIFF(ifd0, gps []tiffEntry) []byte {
+	le := binary.LittleEndian
+	out := []byte("II*\x00\x08\x00\x00\x00")
+
+	writeIFD := func(entries []tiffEntry) int {
+		start := len(out)
+		dataOffset := start + 2 + len(entries)*12 + 4
+		var values []byte
+
+		out = le.AppendUint16(out, uint16(len(entries)))
+		for _, e := range entries {
+			out = le.AppendUint16(out, e.tag)
+			out = le.AppendUint16(out, e.typ)
+			out = le.AppendUint32(out, e.count)
+			if len(e.value) <= 4 {
+				out = append(out, append(e.value, make([]byte, 4-len(e.value))...)...)
+			} else {
+				out = le.AppendUint32(out, uint32(dataOffset+len(values)))
+				values = append(values, e.value...)
+			}
+		}
+		out = le.AppendUint32(out, 0)
+		out = append(out, values...)
+		return start
+	}
+
+	gpsPointer := tiffEntry{0x8825, 4, 1, le.AppendUint32(nil, 0)}
+	writeIFD(append(ifd0, gpsPointer))
+	gpsOffset := writeIFD(gps)
+
+	// patch the GPS pointer, the last entry of IFD0
+	le.PutUint32(out[8+2+len(ifd0)*12+8:], uint32(gpsOffset))
+
+	return out
+}
+
+func rationals(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func TestExtractMetadata(t *testing.T) {
+	tiff := buildTIFF(
+		[]tiffEntry{{0x010F, 2, 6, []byte("Canon\x00")}},
+		[]tiffEntry{
+			{0x0001, 2, 2, []byte("S\x00")},
+			{0x0002, 5, 3, rationals(33, 1, 51, 1, 3600, 100)},
+			{0x0003, 2, 2, []byte("E\x00")},
+			{0x0004, 5, 3, rationals(151, 1, 12, 1, 3600, 100)},
+		},
+	)
+
+	exifData, err := exif.Decode(tiff)
+	if err != nil {
+		t.Fatalf("cannot decode exif: %v", err)
+	}
+
+	caption := "Opera House at dusk"
+	app13 := append([]byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(5+len(caption)))...)
+	app13 = append(app13, 0x1C, 2, 120, 0, byte(len(caption)))
+	app13 = append(app13, caption...)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 10, 10)), nil); err != nil {
+		t.Fatalf("cannot encode test image: %v", err)
+	}
+	content := append([]byte{0xFF, 0xD8, 0xFF, 0xED, 0, byte(len(app13) + 2)}, app13...)
+	content = append(content, buf.Bytes()[2:]...)
+
+	m := extractMetadata(exifData, readIPTC(content, "image/jpeg"))
+
+	if m.CameraMake != "Canon" {
+		t.Errorf("expected camera make Canon, got %q", m.CameraMake)
+	}
+	if m.Caption != caption {
+		t.Errorf("expected caption %q, got %q", caption, m.Caption)
+	}
+	if m.GPS == nil || math.Abs(m.GPS.Latitude+33.86) > 1e-9 || math.Abs(m.GPS.Longitude-151.21) > 1e-9 {
+		t.Errorf("expected GPS -33.86,151.21, got %+v", m.GPS)
+	}
+}
+
+func TestComputeLayout(t *testing.T) {
+	rect := func(x0, y0, x1, y1 int) image.Rectangle { return image.Rect(x0, y0, x1, y1) }
+
+	tests := []struct {
+		name   string
+		opts   ImageProcessingOption
+		scaled image.Point
+		crop   image.Rectangle
+		canvas image.Point
+		offset image.Point
+	}{
+		{"legacy scales down", ImageProcessingOption{Width: 100}, image.Pt(100, 50), rect(0, 0, 100, 50), image.Pt(100, 50), image.Point{}},
+		{"legacy never enlarges", ImageProcessingOption{Width: 400}, image.Pt(200, 100), rect(0, 0, 200, 100), image.Pt(200, 100), image.Point{}},
+		{"cover centers", ImageProcessingOption{Width: 50, Height: 50, Fit: FitCover}, image.Pt(100, 50), rect(25, 0, 75, 50), image.Pt(50, 50), image.Point{}},
+		{"crop is cover", ImageProcessingOption{Width: 50, Height: 50, Crop: true}, image.Pt(100, 50), rect(25, 0, 75, 50), image.Pt(50, 50), image.Point{}},
+		{"crop never enlarges", ImageProcessingOption{Width: 400, Height: 300, Crop: true}, image.Pt(200, 100), rect(0, 0, 200, 100), image.Pt(200, 100), image.Point{}},
+		{"crop needs both sides larger", ImageProcessingOption{Width: 100, Height: 150, Crop: true}, image.Pt(200, 100), rect(0, 0, 200, 100), image.Pt(200, 100), image.Point{}},
+		{"cover enlarges", ImageProcessingOption{Width: 400, Height: 300, Fit: FitCover}, image.Pt(600, 300), rect(100, 0, 500, 300), image.Pt(400, 300), image.Point{}},
+		{"cover gravity", ImageProcessingOption{Width: 50, Height: 50, Fit: FitCover, Gravity: "east"}, image.Pt(100, 50), rect(50, 0, 100, 50), image.Pt(50, 50), image.Point{}},
+		{"cover focal point", ImageProcessingOption{Width: 50, Height: 50, Fit: FitCover, FocalPoint: &data.FocalPoint{X: 0.3, Y: 0.5}}, image.Pt(100, 50), rect(5, 0, 55, 50), image.Pt(50, 50), image.Point{}},
+		{"focal point clamped", ImageProcessingOption{Width: 50, Height: 50, Fit: FitCover, FocalPoint: &data.FocalPoint{X: 0.05, Y: 0.5}}, image.Pt(100, 50), rect(0, 0, 50, 50), image.Pt(50, 50), image.Point{}},
+		{"contain enlarges", ImageProcessingOption{Width: 400, Height: 400, Fit: FitContain}, image.Pt(400, 200), rect(0, 0, 400, 200), image.Pt(400, 200), image.Point{}},
+		{"inside does not", ImageProcessingOption{Width: 400, Height: 400, Fit: FitInside}, image.Pt(200, 100), rect(0, 0, 200, 100), image.Pt(200, 100), image.Point{}},
+		{"outside covers", ImageProcessingOption{Width: 100, Height: 100, Fit: FitOutside}, image.Pt(200, 100), rect(0, 0, 200, 100), image.Pt(200, 100), image.Point{}},
+		{"fill stretches", ImageProcessingOption{Width: 60, Height: 60, Fit: FitFill}, image.Pt(60, 60), rect(0, 0, 60, 60), image.Pt(60, 60), image.Point{}},
+		{"pad centers", ImageProcessingOption{Width: 100, Height: 100, Fit: FitPad}, image.Pt(100, 50), rect(0, 0, 100, 50), image.Pt(100, 100), image.Pt(0, 25)},
+		{"pad gravity", ImageProcessingOption{Width: 100, Height: 100, Fit: FitPad, Gravity: "south"}, image.Pt(100, 50), rect(0, 0, 100, 50), image.Pt(100, 100), image.Pt(0, 50)},
+	}
+
+	for _, tt := range tests {
+		l := computeLayout(200, 100, &tt.opts)
+		if l.scaled != tt.scaled || l.crop != tt.crop || l.canvas != tt.canvas || l.offset != tt.offset {
+			t.Errorf("%s: got %+v", tt.name, l)
+		}
+	}
+}
+
+func TestComputeLayoutExtremeAspectRatio(t *testing.T) {
+	// a valid 50x10000 upload, cover would scale it to 6000x1200000
+	l := computeLayout(50, 10000, &ImageProcessingOption{Width: 6000, Height: 50, Fit: FitCover})
+	if l.crop.Size() != image.Pt(6000, 50) {
+		t.Fatalf("expected a 6000x50 crop, got %v", l.crop)
+	}
+	if src := l.source(50, 10000); src.Dx() != 50 || src.Dy() > 2 {
+		t.Fatalf("expected at most 50x2 source pixels to be scaled, got %v", src)
+	}
+
+	l = computeLayout(50, 10000, &ImageProcessingOption{Width: 6000, Fit: FitContain})
+	if l.scaled != image.Pt(50, 10000) {
+		t.Fatalf("expected contain not to enlarge past %d pixels, got %v", MAX_IMAGE_DIM, l.scaled)
+	}
+
+	l = computeLayout(30, 3000, &ImageProcessingOption{Width: 6000, Height: 6000, Fit: FitPad})
+	if l.scaled != image.Pt(60, 6000) || l.canvas != image.Pt(6000, 6000) {
+		t.Fatalf("expected a 60x6000 image padded to 6000x6000, got %+v", l)
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// a flat background with a busy, colorful patch near the right edge
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.NRGBA{240, 240, 240, 255}
+			if x >= 300 && x < 380 && y >= 60 && y < 140 && (x/4+y/4)%2 == 0 {
+				c = color.NRGBA{220, 30, 30, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	crop := smartCrop(img, image.Pt(200, 100), image.Pt(100, 100))
+	if crop.Min.X < 70 || crop.Dx() != 100 || crop.Dy() != 100 {
+		t.Fatalf("expected the window to cover the patch at x 150-190, got %v", crop)
+	}
+
+	if again := smartCrop(img, image.Pt(200, 100), image.Pt(100, 100)); again != crop {
+		t.Fatalf("expected the same window twice, got %v and %v", crop, again)
+	}
+
+	flat := imaging.New(400, 200, color.White)
+	if crop := smartCrop(flat, image.Pt(200, 100), image.Pt(100, 100)); crop != image.Rect(50, 0, 150, 100) {
+		t.Fatalf("expected a flat image to be cropped in the center, got %v", crop)
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	v := validator.New()
+	ops := ParseOperations(v, "rotate:90|resize:800x0|sharpen:1.20|blur:2")
+	if !v.Valid() {
+		t.Fatalf("expected a valid chain, got %v", v.Errors)
+	}
+	if got := CanonicalOperations(ops); got != "rotate:90|resize:800x0|sharpen:1.2|blur:2" {
+		t.Fatalf("unexpected canonical chain %q", got)
+	}
+
+	// a 4000x3000 photo turned on its side and scaled to 800 wide
+	ValidatePipelineCost(v, ops, 4000, 3000)
+	if !v.Valid() {
+		t.Fatalf("expected the chain to be affordable, got %v", v.Errors)
+	}
+	width, height := 4000, 3000
+	for _, op := range ops {
+		width, height = op.Size(width, height)
+	}
+	if width != 800 || height != 1067 {
+		t.Fatalf("expected an 800x1067 result, got %dx%d", width, height)
+	}
+
+	v = validator.New()
+	ParseOperations(v, "rotate:45|resize:800|grayscale|swirl:3")
+	for _, key := range []string{"ops[0]", "ops[1]", "ops[3]"} {
+		if _, ok := v.Errors[key]; !ok {
+			t.Errorf("expected an error for %s, got %v", key, v.Errors)
+		}
+	}
+	if _, ok := v.Errors["ops[2]"]; ok {
+		t.Errorf("expected no error for the valid ops[2], got %v", v.Errors)
+	}
+
+	v = validator.New()
+	ValidatePipelineCost(v, ParseOperations(v, "blur:10|blur:10"), 6000, 4000)
+	if _, ok := v.Errors["ops"]; !ok {
+		t.Errorf("expected the chain to be too expensive, got %v", v.Errors)
+	}
+
+	// uploads may be larger than MAX_IMAGE_DIM, as long as nothing grows
+	v = validator.New()
+	ValidatePipelineCost(v, ParseOperations(v, "flip:h|rotate:90"), 10000, 5000)
+	if !v.Valid() {
+		t.Errorf("expected steps keeping the size of a large image to be valid, got %v", v.Errors)
+	}
+	v = validator.New()
+	ValidatePipelineCost(v, ParseOperations(v, "resize:6000x0"), 1000, 5000)
+	if _, ok := v.Errors["ops[0]"]; !ok {
+		t.Errorf("expected growing past %d pixels to be rejected, got %v", MAX_IMAGE_DIM, v.Errors)
+	}
+}
+
+func TestCropOperationOnThinImage(t *testing.T) {
+	v := validator.New()
+	ops := ParseOperations(v, "resize:99x6000|crop:6000x50")
+	if !v.Valid() {
+		t.Fatalf("expected a valid chain, got %v", v.Errors)
+	}
+
+	// the crop window of a 99x6000 image is 99x1, not a 6000x363636 cover
+	if cost := ops[1].Cost(99, 6000); cost > 5 {
+		t.Fatalf("expected the crop to be cheap, got a cost of %g", cost)
+	}
+
+	img := ops[1].Apply(imaging.New(99, 6000, color.White))
+	if img.Bounds().Size() != image.Pt(6000, 50) {
+		t.Fatalf("expected a 6000x50 image, got %v", img.Bounds())
+	}
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
@@ -9,7 +10,6 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
 
 	"github.com/mnabil1718/blog.mnabil.dev/internal/data"
 	"github.com/mnabil1718/blog.mnabil.dev/internal/validator"
@@ -27,6 +27,10 @@ var (
 	ErrSystem            = errors.New("system error")
 	ErrFileMove          = errors.New("failed to move file")
 	ErrOpenImage         = errors.New("cannot open file for processing")
+	ErrFileNotFound      = errors.New("file not found")
+	ErrFrameOutOfRange   = errors.New("frame does not exist in this image")
+	ErrNotAcceptable     = errors.New("none of the accepted formats can be produced")
+	ErrImageTooLarge     = errors.New("image dimensions exceed the allowed limits")
 )
 
 var CONTENT_DECODERS = map[string](func(r io.Reader) (image.Config, error)){
@@ -47,6 +51,16 @@ var EXT_MAP = map[string]string{
 	"image/bmp":  ".bmp",
 }
 
+// FORMAT_MAP maps the values of the fm processing param to MIME types.
+var FORMAT_MAP = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"tiff": "image/tiff",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+}
+
 func detectMimeType(file multipart.File) (string, error) {
 	buffer := make([]byte, 512)
 	if _, err := file.Read(buffer); err != nil {
@@ -58,7 +72,7 @@ func detectMimeType(file multipart.File) (string, error) {
 	return http.DetectContentType(buffer), nil
 }
 
-func decodeImageMetadata(file multipart.File, mimeType string) (int, int, error) {
+func decodeImageMetadata(file io.ReadSeeker, mimeType string) (int, int, error) {
 	decoder, ok := CONTENT_DECODERS[mimeType]
 	if !ok {
 		return 0, 0, ErrUnsupportedFormat
@@ -73,26 +87,29 @@ func decodeImageMetadata(file multipart.File, mimeType string) (int, int, error)
 	return config.Width, config.Height, nil
 }
 
-func validateImage(v *validator.Validator, image *data.Image) error {
-	if data.ValidateImage(v, image); !v.Valid() {
-		return ErrValidation
-	}
-	return nil
+// Limits caps the decoded size of an image. Compressed formats can
+// declare huge dimensions in a tiny file, decoding allocates memory
+// for every pixel, so the declared size is checked before decoding.
+type Limits struct {
+	MaxPixels    int64
+	MaxDimension int
 }
 
-func saveFileToDisk(file multipart.File, filePath string) error {
-	f, err := os.Create(filePath)
-	if err != nil {
-		return ErrFileCreate
+func (l Limits) Check(width, height int) error {
+	if width > l.MaxDimension || height > l.MaxDimension {
+		return fmt.Errorf("%w: %dx%d, each side must be at most %d pixels", ErrImageTooLarge, width, height, l.MaxDimension)
 	}
-	defer f.Close()
 
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return ErrSystem
+	if int64(width)*int64(height) > l.MaxPixels {
+		return fmt.Errorf("%w: %dx%d, must be at most %d pixels in total", ErrImageTooLarge, width, height, l.MaxPixels)
 	}
 
-	if _, err := io.Copy(f, file); err != nil {
-		return ErrSystem
+	return nil
+}
+
+func validateImage(v *validator.Validator, image *data.Image) error {
+	if data.ValidateImage(v, image); !v.Valid() {
+		return ErrValidation
 	}
 	return nil
 }
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS images_deleted_at_idx;
+
+ALTER TABLE images DROP COLUMN IF EXISTS deleted_at;
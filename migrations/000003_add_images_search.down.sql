@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS images_search_idx;
+
+ALTER TABLE images DROP COLUMN IF EXISTS search;
@@ -0,0 +1,8 @@
+-- searchable text is the alt text plus the slug part of the name,
+-- i.e. everything before the "-<uuid>-<timestamp>" suffix
+ALTER TABLE images ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+ setweight(to_tsvector('english', coalesce(alt, '')), 'A') ||
+ setweight(to_tsvector('english', translate(regexp_replace(name, '-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}-[0-9]{8}_[0-9]{6}$', ''), '-', ' ')), 'B')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS images_search_idx ON images USING GIN (search);
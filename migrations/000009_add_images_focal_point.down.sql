@@ -0,0 +1,4 @@
+ALTER TABLE images DROP CONSTRAINT IF EXISTS images_focal_point_check;
+
+ALTER TABLE images DROP COLUMN IF EXISTS focal_y;
+ALTER TABLE images DROP COLUMN IF EXISTS focal_x;
@@ -0,0 +1,7 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS focal_x double precision;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS focal_y double precision;
+
+ALTER TABLE images ADD CONSTRAINT images_focal_point_check CHECK (
+ (focal_x IS NULL AND focal_y IS NULL) OR
+ (focal_x BETWEEN 0 AND 1 AND focal_y BETWEEN 0 AND 1)
+);